@@ -0,0 +1,334 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"sigs.k8s.io/yaml"
+)
+
+// configAPIVersion is the version of the configuration file understood by this binary.
+const configAPIVersion = "v1"
+
+// config is the configuration file read from --config, in YAML or JSON. Every field stands for a flag,
+// which takes precedence when set on the command line. The key is re-read on SIGHUP.
+//
+//	apiVersion: v1
+//	kms: v2
+//	key:
+//	  uri: projects/my-project/locations/my-location/keyRings/my-key-ring/cryptoKeys/my-key
+//	resilience:
+//	  retry:
+//	    attempts: 4
+type config struct {
+	APIVersion string           `json:"apiVersion"`
+	KMS        string           `json:"kms"`
+	Key        keyConfig        `json:"key"`
+	Socket     socketConfig     `json:"socket"`
+	Healthz    healthzConfig    `json:"healthz"`
+	Metrics    metricsConfig    `json:"metrics"`
+	Auth       authConfig       `json:"auth"`
+	Resilience resilienceConfig `json:"resilience"`
+	Tracing    tracingConfig    `json:"tracing"`
+}
+
+type keyConfig struct {
+	URI               string   `json:"uri"`
+	Suffix            string   `json:"suffix"`
+	Type              string   `json:"type"`
+	AAD               string   `json:"aad"`
+	DecryptWithoutAAD *bool    `json:"decryptWithoutAAD"`
+	DecryptURIs       []string `json:"decryptURIs"`
+	ReplicaURIs       []string `json:"replicaURIs"`
+	MinReplicaCopies  *int     `json:"minReplicaCopies"`
+	LocalEncryption   *bool    `json:"localEncryption"`
+	DEKLifetime       string   `json:"dekLifetime"`
+	PollInterval      string   `json:"pollInterval"`
+	DecryptCacheSize  *int     `json:"decryptCacheSize"`
+	DecryptCacheTTL   string   `json:"decryptCacheTTL"`
+
+	Rotation rotationConfig `json:"rotation"`
+}
+
+type rotationConfig struct {
+	CheckInterval string `json:"checkInterval"`
+	MaxAge        string `json:"maxAge"`
+	FailHealthz   *bool  `json:"failHealthz"`
+}
+
+type socketConfig struct {
+	Path string `json:"path"`
+}
+
+type healthzConfig struct {
+	Port          *int   `json:"port"`
+	Path          string `json:"path"`
+	Timeout       string `json:"timeout"`
+	CheckInterval string `json:"checkInterval"`
+	CheckKeyState *bool  `json:"checkKeyState"`
+	CheckKeyID    *bool  `json:"checkKeyID"`
+
+	Address string    `json:"address"`
+	TLS     tlsConfig `json:"tls"`
+}
+
+type metricsConfig struct {
+	Port *int   `json:"port"`
+	Path string `json:"path"`
+
+	Address string    `json:"address"`
+	TLS     tlsConfig `json:"tls"`
+
+	Legacy *bool `json:"legacy"`
+}
+
+type tlsConfig struct {
+	CertFile     string `json:"certFile"`
+	KeyFile      string `json:"keyFile"`
+	ClientCAFile string `json:"clientCAFile"`
+}
+
+type authConfig struct {
+	GCEConfig string `json:"gceConfig"`
+}
+
+type resilienceConfig struct {
+	Retry               retryConfig          `json:"retry"`
+	CircuitBreaker      circuitBreakerConfig `json:"circuitBreaker"`
+	MaxConcurrency      *int                 `json:"maxConcurrency"`
+	RateLimit           *float64             `json:"rateLimit"`
+	RateBurst           *int                 `json:"rateBurst"`
+	ShutdownGracePeriod string               `json:"shutdownGracePeriod"`
+}
+
+type retryConfig struct {
+	Attempts       *int   `json:"attempts"`
+	InitialBackoff string `json:"initialBackoff"`
+	MaxBackoff     string `json:"maxBackoff"`
+}
+
+type circuitBreakerConfig struct {
+	Threshold *int   `json:"threshold"`
+	Cooldown  string `json:"cooldown"`
+}
+
+type tracingConfig struct {
+	Endpoint               string `json:"endpoint"`
+	SamplingRatePerMillion *int   `json:"samplingRatePerMillion"`
+}
+
+// configValue is the value of a field of the configuration file for a flag.
+type configValue struct {
+	field string
+	flag  string
+	value string
+}
+
+// values lists the fields set in c together with the flags they stand for.
+func (c *config) values() []configValue {
+	var values []configValue
+	str := func(field, flag, v string) {
+		if v != "" {
+			values = append(values, configValue{field, flag, v})
+		}
+	}
+	list := func(field, flag string, v []string) {
+		str(field, flag, strings.Join(v, ","))
+	}
+	integer := func(field, flag string, v *int) {
+		if v != nil {
+			str(field, flag, strconv.Itoa(*v))
+		}
+	}
+	boolean := func(field, flag string, v *bool) {
+		if v != nil {
+			str(field, flag, strconv.FormatBool(*v))
+		}
+	}
+
+	str("kms", "kms", c.KMS)
+	str("key.uri", "key-uri", c.Key.URI)
+	str("key.suffix", "key-suffix", c.Key.Suffix)
+	str("key.type", "key-type", c.Key.Type)
+	str("key.aad", "aad", c.Key.AAD)
+	boolean("key.decryptWithoutAAD", "decrypt-without-aad", c.Key.DecryptWithoutAAD)
+	list("key.decryptURIs", "decrypt-key-uris", c.Key.DecryptURIs)
+	list("key.replicaURIs", "replica-key-uris", c.Key.ReplicaURIs)
+	integer("key.minReplicaCopies", "min-replica-copies", c.Key.MinReplicaCopies)
+	boolean("key.localEncryption", "local-encryption", c.Key.LocalEncryption)
+	str("key.dekLifetime", "dek-lifetime", c.Key.DEKLifetime)
+	str("key.pollInterval", "key-poll-interval", c.Key.PollInterval)
+	integer("key.decryptCacheSize", "decrypt-cache-size", c.Key.DecryptCacheSize)
+	str("key.decryptCacheTTL", "decrypt-cache-ttl", c.Key.DecryptCacheTTL)
+	str("key.rotation.checkInterval", "key-rotation-check-interval", c.Key.Rotation.CheckInterval)
+	str("key.rotation.maxAge", "key-rotation-max-age", c.Key.Rotation.MaxAge)
+	boolean("key.rotation.failHealthz", "key-rotation-fail-healthz", c.Key.Rotation.FailHealthz)
+	str("socket.path", "path-to-unix-socket", c.Socket.Path)
+	integer("healthz.port", "healthz-port", c.Healthz.Port)
+	str("healthz.path", "healthz-path", c.Healthz.Path)
+	str("healthz.timeout", "healthz-timeout", c.Healthz.Timeout)
+	str("healthz.checkInterval", "healthz-check-interval", c.Healthz.CheckInterval)
+	boolean("healthz.checkKeyState", "healthz-check-key-state", c.Healthz.CheckKeyState)
+	boolean("healthz.checkKeyID", "healthz-check-key-id", c.Healthz.CheckKeyID)
+	str("healthz.address", "healthz-address", c.Healthz.Address)
+	str("healthz.tls.certFile", "healthz-tls-cert-file", c.Healthz.TLS.CertFile)
+	str("healthz.tls.keyFile", "healthz-tls-key-file", c.Healthz.TLS.KeyFile)
+	str("healthz.tls.clientCAFile", "healthz-tls-client-ca-file", c.Healthz.TLS.ClientCAFile)
+	integer("metrics.port", "metrics-port", c.Metrics.Port)
+	str("metrics.path", "metrics-path", c.Metrics.Path)
+	str("metrics.address", "metrics-address", c.Metrics.Address)
+	str("metrics.tls.certFile", "metrics-tls-cert-file", c.Metrics.TLS.CertFile)
+	str("metrics.tls.keyFile", "metrics-tls-key-file", c.Metrics.TLS.KeyFile)
+	str("metrics.tls.clientCAFile", "metrics-tls-client-ca-file", c.Metrics.TLS.ClientCAFile)
+	boolean("metrics.legacy", "legacy-metrics", c.Metrics.Legacy)
+	str("auth.gceConfig", "gce-config", c.Auth.GCEConfig)
+	integer("resilience.retry.attempts", "retry-attempts", c.Resilience.Retry.Attempts)
+	str("resilience.retry.initialBackoff", "retry-initial-backoff", c.Resilience.Retry.InitialBackoff)
+	str("resilience.retry.maxBackoff", "retry-max-backoff", c.Resilience.Retry.MaxBackoff)
+	integer("resilience.circuitBreaker.threshold", "circuit-breaker-threshold", c.Resilience.CircuitBreaker.Threshold)
+	str("resilience.circuitBreaker.cooldown", "circuit-breaker-cooldown", c.Resilience.CircuitBreaker.Cooldown)
+	integer("resilience.maxConcurrency", "grpc-max-concurrency", c.Resilience.MaxConcurrency)
+	if v := c.Resilience.RateLimit; v != nil {
+		str("resilience.rateLimit", "grpc-rate-limit", strconv.FormatFloat(*v, 'g', -1, 64))
+	}
+	integer("resilience.rateBurst", "grpc-rate-burst", c.Resilience.RateBurst)
+	str("resilience.shutdownGracePeriod", "shutdown-grace-period", c.Resilience.ShutdownGracePeriod)
+	str("tracing.endpoint", "tracing-endpoint", c.Tracing.Endpoint)
+	integer("tracing.samplingRatePerMillion", "tracing-sampling-rate-per-million", c.Tracing.SamplingRatePerMillion)
+
+	return values
+}
+
+// readConfig reads and validates the configuration file at path.
+// Unknown fields are rejected, so that a misspelt setting does not silently fall back to its default.
+func readConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s, error: %w", path, err)
+	}
+
+	c := &config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("failed to parse %s, error: %w", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// validate checks the fields of c on their own, the settings are validated as a whole with the flags.
+func (c *config) validate() error {
+	var errs []error
+	if c.APIVersion != configAPIVersion {
+		errs = append(errs, fmt.Errorf("apiVersion must be %q, got %q", configAPIVersion, c.APIVersion))
+	}
+	if c.KMS != "" && c.KMS != "v1" && c.KMS != "v2" {
+		errs = append(errs, fmt.Errorf("kms must be v1 or v2, got %q", c.KMS))
+	}
+	if c.Key.Type != "" && c.Key.Type != "symmetric" && c.Key.Type != "asymmetric" {
+		errs = append(errs, fmt.Errorf("key.type must be symmetric or asymmetric, got %q", c.Key.Type))
+	}
+	for _, v := range c.values() {
+		if err := validateValue(v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateValue checks that v parses as a value of its flag (ex. a duration), without setting the flag.
+func validateValue(v configValue) error {
+	f := flag.Lookup(v.flag)
+	if f == nil {
+		return fmt.Errorf("%s: unknown flag --%s", v.field, v.flag)
+	}
+
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	switch f.Value.(flag.Getter).Get().(type) {
+	case bool:
+		fs.Bool(v.flag, false, "")
+	case int:
+		fs.Int(v.flag, 0, "")
+	case float64:
+		fs.Float64(v.flag, 0, "")
+	case time.Duration:
+		fs.Duration(v.flag, 0, "")
+	default:
+		return nil
+	}
+	if err := fs.Set(v.flag, v.value); err != nil {
+		return fmt.Errorf("%s: invalid value %q, error: %w", v.field, v.value, err)
+	}
+	return nil
+}
+
+// commandLineFlags are the flags set on the command line, which take precedence over --config.
+var commandLineFlags = make(map[string]bool)
+
+// mustApplyConfig sets the flags not set on the command line from --config, if any.
+func mustApplyConfig() {
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+	if *configPath == "" {
+		return
+	}
+
+	c, err := readConfig(*configPath)
+	if err != nil {
+		glog.Exitf("Invalid --config: %v", err)
+	}
+	for _, v := range c.values() {
+		if commandLineFlags[v.flag] {
+			continue
+		}
+		if err := flag.Set(v.flag, v.value); err != nil {
+			glog.Exitf("Invalid --config: %s: %v", v.field, err)
+		}
+	}
+}
+
+// reloadKey re-reads the key to encrypt with from --config. Flags set on the command line take precedence.
+func reloadKey() (uri, suffix string, err error) {
+	c, err := readConfig(*configPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	uri, suffix = c.Key.URI, c.Key.Suffix
+	if commandLineFlags["key-uri"] {
+		uri = *keyURI
+	}
+	if commandLineFlags["key-suffix"] {
+		suffix = *keySuffix
+	}
+
+	if uri == "" {
+		return "", "", errors.New("key.uri must be set")
+	}
+	if strings.Contains(uri, "/cryptoKeyVersions/") {
+		return "", "", fmt.Errorf("key.uri must be a crypto key rather than a key version, got %s", uri)
+	}
+	return uri, suffix, nil
+}
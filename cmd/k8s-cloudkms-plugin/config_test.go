@@ -0,0 +1,348 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The tests below read and set the flags of the plugin, so none of them run in parallel.
+
+// writeConfig writes content to a configuration file in a temporary directory and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write %s, error: %v", path, err)
+	}
+	return path
+}
+
+func TestReadConfig(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		content string
+		// wantErr is a substring of the expected error, empty when the file is valid.
+		wantErr string
+		want    []configValue
+	}{
+		{
+			desc: "YAML",
+			content: `
+apiVersion: v1
+kms: v2
+key:
+  uri: projects/p/locations/l/keyRings/r/cryptoKeys/k
+  decryptURIs: [projects/p/locations/l/keyRings/r/cryptoKeys/old]
+  dekLifetime: 1h
+resilience:
+  retry:
+    attempts: 2
+  rateLimit: 0.5
+`,
+			want: []configValue{
+				{"kms", "kms", "v2"},
+				{"key.uri", "key-uri", "projects/p/locations/l/keyRings/r/cryptoKeys/k"},
+				{"key.decryptURIs", "decrypt-key-uris", "projects/p/locations/l/keyRings/r/cryptoKeys/old"},
+				{"key.dekLifetime", "dek-lifetime", "1h"},
+				{"resilience.retry.attempts", "retry-attempts", "2"},
+				{"resilience.rateLimit", "grpc-rate-limit", "0.5"},
+			},
+		},
+		{
+			desc:    "JSON",
+			content: `{"apiVersion": "v1", "healthz": {"checkKeyState": false}}`,
+			want: []configValue{
+				{"healthz.checkKeyState", "healthz-check-key-state", "false"},
+			},
+		},
+		{
+			desc:    "Missing apiVersion",
+			content: "kms: v2\n",
+			wantErr: `apiVersion must be "v1", got ""`,
+		},
+		{
+			desc:    "Wrong apiVersion",
+			content: "apiVersion: v2\n",
+			wantErr: `apiVersion must be "v1", got "v2"`,
+		},
+		{
+			desc:    "Unknown field",
+			content: "apiVersion: v1\nkey:\n  uri: projects/p/locations/l/keyRings/r/cryptoKeys/k\n  sufix: a\n",
+			wantErr: `unknown field "sufix"`,
+		},
+		{
+			desc:    "Unknown section",
+			content: "apiVersion: v1\nretry:\n  attempts: 2\n",
+			wantErr: `unknown field "retry"`,
+		},
+		{
+			desc:    "Invalid duration",
+			content: "apiVersion: v1\nkey:\n  dekLifetime: a fortnight\n",
+			wantErr: `key.dekLifetime: invalid value "a fortnight"`,
+		},
+		{
+			desc:    "Duration without unit",
+			content: "apiVersion: v1\nresilience:\n  retry:\n    initialBackoff: 100\n",
+			wantErr: `resilience.retry.initialBackoff: invalid value "100"`,
+		},
+		{
+			desc:    "Integer of the wrong type",
+			content: "apiVersion: v1\nresilience:\n  retry:\n    attempts: four\n",
+			wantErr: "failed to parse",
+		},
+		{
+			desc:    "Unknown KMS API version",
+			content: "apiVersion: v1\nkms: v3\n",
+			wantErr: `kms must be v1 or v2, got "v3"`,
+		},
+		{
+			desc:    "Unknown key type",
+			content: "apiVersion: v1\nkey:\n  type: hmac\n",
+			wantErr: `key.type must be symmetric or asymmetric, got "hmac"`,
+		},
+		{
+			desc:    "Not YAML",
+			content: "apiVersion: [v1\n",
+			wantErr: "failed to parse",
+		},
+	}
+
+	for _, testCase := range testCases {
+		c, err := readConfig(writeConfig(t, testCase.content))
+		if testCase.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), testCase.wantErr) {
+				t.Fatalf("%s: got error %v, want one containing %q", testCase.desc, err, testCase.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to read the configuration, error: %v", testCase.desc, err)
+		}
+
+		got := c.values()
+		if len(got) != len(testCase.want) {
+			t.Fatalf("%s: got values %v, want %v", testCase.desc, got, testCase.want)
+		}
+		for i := range got {
+			if got[i] != testCase.want[i] {
+				t.Fatalf("%s: got value %v, want %v", testCase.desc, got[i], testCase.want[i])
+			}
+		}
+	}
+
+	if _, err := readConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("Expected reading a configuration file that does not exist to fail")
+	}
+}
+
+func TestValidateValue(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		value   configValue
+		wantErr bool
+	}{
+		{
+			desc:  "Duration",
+			value: configValue{"key.dekLifetime", "dek-lifetime", "90m"},
+		},
+		{
+			desc:    "Invalid duration",
+			value:   configValue{"key.dekLifetime", "dek-lifetime", "1d"},
+			wantErr: true,
+		},
+		{
+			desc:  "Integer",
+			value: configValue{"key.minReplicaCopies", "min-replica-copies", "-1"},
+		},
+		{
+			desc:    "Invalid integer",
+			value:   configValue{"key.minReplicaCopies", "min-replica-copies", "1.5"},
+			wantErr: true,
+		},
+		{
+			desc:  "Float",
+			value: configValue{"resilience.rateLimit", "grpc-rate-limit", "2.5"},
+		},
+		{
+			desc:    "Invalid float",
+			value:   configValue{"resilience.rateLimit", "grpc-rate-limit", "fast"},
+			wantErr: true,
+		},
+		{
+			desc:  "Boolean",
+			value: configValue{"key.localEncryption", "local-encryption", "true"},
+		},
+		{
+			desc:    "Invalid boolean",
+			value:   configValue{"key.localEncryption", "local-encryption", "sometimes"},
+			wantErr: true,
+		},
+		{
+			desc:  "String is not validated",
+			value: configValue{"key.uri", "key-uri", "anything"},
+		},
+		{
+			desc:    "Unknown flag",
+			value:   configValue{"key.name", "key-name", "k"},
+			wantErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		before := flag.Lookup(testCase.value.flag)
+		var beforeValue string
+		if before != nil {
+			beforeValue = before.Value.String()
+		}
+
+		err := validateValue(testCase.value)
+		if got := err != nil; got != testCase.wantErr {
+			t.Fatalf("%s: got error %v, want error %t", testCase.desc, err, testCase.wantErr)
+		}
+		if before != nil && before.Value.String() != beforeValue {
+			t.Fatalf("%s: validation set --%s to %s", testCase.desc, testCase.value.flag, before.Value.String())
+		}
+	}
+}
+
+func TestMustApplyConfig(t *testing.T) {
+	savedConfigPath, savedKeyURI, savedKeySuffix := *configPath, *keyURI, *keySuffix
+	savedRetryAttempts, savedDEKLifetime := *retryAttempts, *dekLifetime
+	t.Cleanup(func() {
+		*configPath, *keyURI, *keySuffix = savedConfigPath, savedKeyURI, savedKeySuffix
+		*retryAttempts, *dekLifetime = savedRetryAttempts, savedDEKLifetime
+		clear(commandLineFlags)
+	})
+
+	// --key-suffix and --retry-attempts are set on the command line and take precedence over the file.
+	if err := flag.Set("key-suffix", "command-line"); err != nil {
+		t.Fatalf("Failed to set --key-suffix, error: %v", err)
+	}
+	if err := flag.Set("retry-attempts", "1"); err != nil {
+		t.Fatalf("Failed to set --retry-attempts, error: %v", err)
+	}
+	*configPath = writeConfig(t, `
+apiVersion: v1
+key:
+  uri: projects/p/locations/l/keyRings/r/cryptoKeys/file
+  suffix: file
+  dekLifetime: 2h
+resilience:
+  retry:
+    attempts: 3
+`)
+	mustApplyConfig()
+
+	testCases := []struct {
+		desc string
+		got  any
+		want any
+	}{
+		{desc: "Key URI from the file", got: *keyURI, want: "projects/p/locations/l/keyRings/r/cryptoKeys/file"},
+		{desc: "DEK lifetime from the file", got: *dekLifetime, want: 2 * time.Hour},
+		{desc: "Key suffix from the command line", got: *keySuffix, want: "command-line"},
+		{desc: "Retry attempts from the command line", got: *retryAttempts, want: 1},
+	}
+	for _, testCase := range testCases {
+		if testCase.got != testCase.want {
+			t.Fatalf("%s: got %v, want %v", testCase.desc, testCase.got, testCase.want)
+		}
+	}
+}
+
+func TestReloadKey(t *testing.T) {
+	const keyName = "projects/p/locations/l/keyRings/r/cryptoKeys/"
+
+	savedConfigPath, savedKeyURI, savedKeySuffix := *configPath, *keyURI, *keySuffix
+	t.Cleanup(func() {
+		*configPath, *keyURI, *keySuffix = savedConfigPath, savedKeyURI, savedKeySuffix
+		clear(commandLineFlags)
+	})
+	*keyURI, *keySuffix = keyName+"command-line", "command-line"
+
+	testCases := []struct {
+		desc        string
+		content     string
+		commandLine []string
+		wantURI     string
+		wantSuffix  string
+		wantErr     bool
+	}{
+		{
+			desc:       "Key from the file",
+			content:    "apiVersion: v1\nkey:\n  uri: " + keyName + "new\n  suffix: new\n",
+			wantURI:    keyName + "new",
+			wantSuffix: "new",
+		},
+		{
+			desc:        "Key URI set on the command line",
+			content:     "apiVersion: v1\nkey:\n  uri: " + keyName + "new\n  suffix: new\n",
+			commandLine: []string{"key-uri"},
+			wantURI:     keyName + "command-line",
+			wantSuffix:  "new",
+		},
+		{
+			desc:        "Key suffix set on the command line",
+			content:     "apiVersion: v1\nkey:\n  uri: " + keyName + "new\n",
+			commandLine: []string{"key-suffix"},
+			wantURI:     keyName + "new",
+			wantSuffix:  "command-line",
+		},
+		{
+			desc:    "Key URI removed",
+			content: "apiVersion: v1\nkey:\n  suffix: new\n",
+			wantErr: true,
+		},
+		{
+			desc:    "Key version",
+			content: "apiVersion: v1\nkey:\n  uri: " + keyName + "new/cryptoKeyVersions/1\n",
+			wantErr: true,
+		},
+		{
+			desc:    "Invalid file",
+			content: "apiVersion: v1\nkey:\n  url: " + keyName + "new\n",
+			wantErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		clear(commandLineFlags)
+		for _, f := range testCase.commandLine {
+			commandLineFlags[f] = true
+		}
+		*configPath = writeConfig(t, testCase.content)
+
+		uri, suffix, err := reloadKey()
+		if testCase.wantErr {
+			if err == nil {
+				t.Fatalf("%s: got key %s and suffix %q, want an error", testCase.desc, uri, suffix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to reload the key, error: %v", testCase.desc, err)
+		}
+		if uri != testCase.wantURI || suffix != testCase.wantSuffix {
+			t.Fatalf("%s: got key %s and suffix %q, want %s and %q", testCase.desc, uri, suffix, testCase.wantURI, testCase.wantSuffix)
+		}
+	}
+}
@@ -19,11 +19,14 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -36,18 +39,64 @@ import (
 )
 
 var (
-	healthzPort    = flag.Int("healthz-port", 8081, "Port on which to publish healthz")
-	healthzPath    = flag.String("healthz-path", "healthz", "Path at which to publish healthz")
-	healthzTimeout = flag.Duration("healthz-timeout", 5*time.Second, "timeout in seconds for communicating with the unix socket")
+	healthzPort          = flag.Int("healthz-port", 8081, "Port on which to publish healthz")
+	healthzPath          = flag.String("healthz-path", "healthz", "Path at which to publish healthz, which performs the same checks as /readyz. /livez and /readyz, with their checks at /livez/<check> and /readyz/<check>, are published on the same port. ?verbose reports the result of every check and ?format=json reports them as JSON")
+	healthzTimeout       = flag.Duration("healthz-timeout", 5*time.Second, "timeout in seconds for communicating with the unix socket")
+	healthzKeyState      = flag.Bool("healthz-check-key-state", false, "When set, healthz reads the crypto key with CryptoKeys.Get and fails unless its primary version is enabled, reporting the key purpose, primary version state, protection level and next rotation time. Requires cloudkms.cryptoKeys.get permission, which is then also asserted by healthz")
+	healthzKeyID         = flag.Bool("healthz-check-key-id", false, "When set, the ping of healthz with ping-kms=true also fails unless Status reports the key ID Encrypt used, which may happen briefly after the key is rotated. Applicable only in KMS API v2 mode")
+	healthzCheckInterval = flag.Duration("healthz-check-interval", 0, "When set, the healthz checks calling the plugin or Cloud KMS are run in the background at this interval and requests are answered from their latest results, ex. 10s for frequent probes. The ping of ping-kms=true is only run in the background while it keeps being requested. 0 runs the checks on every request")
 
 	metricsPort = flag.Int("metrics-port", 8082, "Port on which to publish metrics")
 	metricsPath = flag.String("metrics-path", "metrics", "Path at which to publish metrics")
 
+	healthzAddress         = flag.String("healthz-address", "localhost", "Address on which to publish healthz, ex. 0.0.0.0 for probes from outside the network namespace of the pod")
+	healthzTLSCertFile     = flag.String("healthz-tls-cert-file", "", "PEM certificate with which to serve healthz over HTTPS, re-read when it changes. Requires --healthz-tls-key-file")
+	healthzTLSKeyFile      = flag.String("healthz-tls-key-file", "", "PEM private key of --healthz-tls-cert-file")
+	healthzTLSClientCAFile = flag.String("healthz-tls-client-ca-file", "", "PEM CA certificates, one of which must have signed the certificate a client presents to healthz. Requires --healthz-tls-cert-file")
+	metricsAddress         = flag.String("metrics-address", "localhost", "Address on which to publish metrics, ex. 0.0.0.0 for scrapes from outside the network namespace of the pod")
+	metricsTLSCertFile     = flag.String("metrics-tls-cert-file", "", "PEM certificate with which to serve metrics over HTTPS, re-read when it changes. Requires --metrics-tls-key-file")
+	metricsTLSKeyFile      = flag.String("metrics-tls-key-file", "", "PEM private key of --metrics-tls-cert-file")
+	metricsTLSClientCAFile = flag.String("metrics-tls-client-ca-file", "", "PEM CA certificates, one of which must have signed the certificate a client presents to metrics. Requires --metrics-tls-cert-file")
+
+	legacyMetrics = flag.Bool("legacy-metrics", true, "When set, metrics are also published under their names from before they were prefixed with cloudkms_plugin_, together with roundtrip_latencies in milliseconds and failures_count. Set to false once dashboards use cloudkms_plugin_cloudkms_request_duration_seconds")
+
 	gceConf          = flag.String("gce-config", "", "Path to gce.conf, if running on GKE.")
+	configPath       = flag.String("config", "", "Path to a versioned YAML or JSON configuration file (apiVersion: v1) covering the settings of the flags, which take precedence when set on the command line. On SIGHUP the key (key.uri and key.suffix) is re-read and the plugin switches to it without re-creating the socket, other changes require a restart. Reloading is applicable only in KMS API v2 mode with a symmetric key, otherwise SIGHUP terminates the plugin")
 	keyURI           = flag.String("key-uri", "", "Uri of the key use for crypto operations (ex. projects/my-project/locations/my-location/keyRings/my-key-ring/cryptoKeys/my-key)")
+	aad              = flag.String("aad", "", "Additional authenticated data (ex. the cluster UID) to bind ciphertexts to, so that they cannot be decrypted by a plugin of another cluster sharing the same key. In v1 mode, payloads encrypted before --aad was set become unreadable unless --decrypt-without-aad is also set")
+	decryptNoAAD     = flag.Bool("decrypt-without-aad", false, "When set to true, payloads that cannot be decrypted with --aad are retried without it, so that payloads encrypted before --aad was set remain readable until re-encrypted. Applicable only in KMS API v1 mode, v2 records the AAD in the annotations")
+	decryptKeyURIs   = flag.String("decrypt-key-uris", "", "Comma separated list of Uris of keys to fall back to, in order, when --key-uri cannot decrypt a payload (ex. keys used before migrating to a new key ring or project)")
+	replicaKeyURIs   = flag.String("replica-key-uris", "", "Comma separated list of Uris of keys, typically in other locations, to additionally wrap every payload with, so that payloads can be decrypted while the location of --key-uri is unavailable. By default Encrypt fails unless every replica key is reachable, see --min-replica-copies. Applicable only in KMS API v2 mode")
+	minReplicaCopies = flag.Int("min-replica-copies", -1, "Number of --replica-key-uris a payload must be wrapped with for Encrypt to succeed, -1 requires all of them. Lower it to keep writes available while a replica location is down, at the cost of payloads written meanwhile lacking those copies")
 	pathToUnixSocket = flag.String("path-to-unix-socket", "/var/run/kmsplugin/socket.sock", "Full path to Unix socket that is used for communicating with KubeAPI Server, or Linux socket namespace object - must start with @")
 	kmsVersion       = flag.String("kms", "v2", "Kubernetes KMS API version. Possible values: v1, v2. Default value is v2.")
+	keyType          = flag.String("key-type", "symmetric", "Type of the Cloud KMS key. Possible values: symmetric, asymmetric. With asymmetric, --key-uri is an RSA_DECRYPT_OAEP key version, payloads are encrypted locally with its public key and only decryption calls Cloud KMS. RSA-OAEP limits payloads to the key size less twice the digest size and two bytes (ex. 190 bytes for RSA_DECRYPT_OAEP_2048_SHA256), which fits the DEK seeds kube-apiserver encrypts in KMS v2 but not arbitrary payloads. Applicable only in KMS API v2 mode")
 	keySuffix        = flag.String("key-suffix", "", "Set to a unique value in case if plugin is reconfigured to use Cloud KMS key version that was already in use before. Applicable only in KMS API v2 mode")
+	localEncryption  = flag.Bool("local-encryption", false, "When set to true, payloads are encrypted locally with a data encryption key wrapped by Cloud KMS instead of sending every payload to Cloud KMS. Applicable only in KMS API v2 mode")
+	dekLifetime      = flag.Duration("dek-lifetime", 24*time.Hour, "How long a locally generated data encryption key is used before a new one is generated. Applicable only with --local-encryption")
+	keyPollInterval  = flag.Duration("key-poll-interval", 0, "When set, the primary key version is read with CryptoKeys.Get at this interval and Status is answered from it, instead of encrypting a ping on every Status call. Each read is bounded by --healthz-timeout. Requires cloudkms.cryptoKeys.get permission, which is then also asserted by healthz. Applicable only in KMS API v2 mode")
+	decryptCacheSize = flag.Int("decrypt-cache-size", 0, "Maximum number of decrypted payloads to cache, 0 disables the cache. Applicable only in KMS API v2 mode")
+	decryptCacheTTL  = flag.Duration("decrypt-cache-ttl", time.Hour, "How long decrypted payloads are kept in the decrypt cache. Applicable only with --decrypt-cache-size")
+
+	rotationCheckInterval = flag.Duration("key-rotation-check-interval", 0, "When set, the crypto key is read with CryptoKeys.Get at this interval to export the age of its primary version, its next rotation time and rotation period as metrics. Requires cloudkms.cryptoKeys.get permission, which is then also asserted by healthz")
+	rotationMaxAge        = flag.Duration("key-rotation-max-age", 0, "When set with --key-rotation-check-interval, a warning is logged while the primary version of the crypto key is older than this, ex. 8760h for yearly rotation")
+	rotationFailHealthz   = flag.Bool("key-rotation-fail-healthz", false, "When set, healthz fails while the primary version is older than --key-rotation-max-age")
+
+	retryAttempts       = flag.Int("retry-attempts", 4, "Maximum number of attempts of a Cloud KMS call failing with a retryable error (429, 5xx or a network error), 1 disables retries")
+	retryInitialBackoff = flag.Duration("retry-initial-backoff", 100*time.Millisecond, "Delay before the first retry of a Cloud KMS call, doubled before every subsequent retry")
+	retryMaxBackoff     = flag.Duration("retry-max-backoff", 2*time.Second, "Maximum delay between retries of a Cloud KMS call")
+
+	breakerThreshold = flag.Int("circuit-breaker-threshold", 0, "Number of consecutive Cloud KMS calls failing because Cloud KMS is unavailable after which calls fail fast, 0 disables the circuit breaker")
+	breakerCooldown  = flag.Duration("circuit-breaker-cooldown", 30*time.Second, "How long calls fail fast once the circuit breaker opened, before a single call probes whether Cloud KMS is available again")
+
+	maxConcurrency = flag.Int("grpc-max-concurrency", 0, "Maximum number of requests served at once, requests over it fail with ResourceExhausted. 0 means unlimited")
+	rateLimit      = flag.Float64("grpc-rate-limit", 0, "Requests per second allowed for each KMS API method (ex. Encrypt), requests over it fail with ResourceExhausted. Healthz pings count against it too. 0 means unlimited")
+	rateBurst      = flag.Int("grpc-rate-burst", 10, "Requests of a KMS API method allowed at once on top of --grpc-rate-limit")
+
+	shutdownGracePeriod = flag.Duration("shutdown-grace-period", 10*time.Second, "How long requests in flight are given to complete on SIGTERM or SIGINT before they are cancelled. Healthz fails and no new connections are accepted meanwhile")
+
+	tracingEndpoint        = flag.String("tracing-endpoint", "", "OTLP/gRPC endpoint, ex. localhost:4317, to export spans of the gRPC requests and the Cloud KMS calls made while serving them to, reached without TLS like by kube-apiserver. The trace context of kube-apiserver is continued, so that the spans join its traces of KMS calls. Empty disables tracing")
+	tracingSamplingPerMill = flag.Int("tracing-sampling-rate-per-million", 0, "Number of requests in a million that are traced when they do not arrive within a trace sampled by kube-apiserver. Applicable only with --tracing-endpoint")
 
 	// Integration testing arguments.
 	integrationTest = flag.Bool("integration-test", false, "When set to true, http.DefaultClient will be used, as opposed callers identity acquired with a TokenService.")
@@ -60,6 +109,7 @@ func main() {
 	defer cancel()
 
 	flag.Parse()
+	mustApplyConfig()
 	mustValidateFlags()
 
 	var (
@@ -86,52 +136,186 @@ func main() {
 		kms.BasePath = fmt.Sprintf("http://localhost:%d", *fakeKMSPort)
 	}
 
+	if *legacyMetrics {
+		plugin.RegisterLegacyMetrics()
+	}
 	metrics := &plugin.Metrics{
 		ServingURL: &url.URL{
-			Host: fmt.Sprintf("localhost:%d", *metricsPort),
+			Host: net.JoinHostPort(*metricsAddress, strconv.Itoa(*metricsPort)),
 			Path: *metricsPath,
 		},
 	}
+	if *metricsTLSCertFile != "" {
+		metrics.TLSConfig, err = plugin.NewTLSConfig(*metricsTLSCertFile, *metricsTLSKeyFile, *metricsTLSClientCAFile)
+		if err != nil {
+			glog.Exitf("failed to load the TLS certificate of metrics: %v", err)
+		}
+	}
+
+	backoff := plugin.Backoff{
+		Attempts: *retryAttempts,
+		Initial:  *retryInitialBackoff,
+		Max:      *retryMaxBackoff,
+		Jitter:   0.2,
+	}
+
+	var breaker *plugin.CircuitBreaker
+	if *breakerThreshold > 0 {
+		breaker = plugin.NewCircuitBreaker(*breakerThreshold, *breakerCooldown)
+	}
 
 	var p plugin.Plugin
 	var healthChecker plugin.HealthChecker
+	var v2Plugin *v2.Plugin
 	switch *kmsVersion {
 	case "v1":
-		p = v1.NewPlugin(kms.Projects.Locations.KeyRings.CryptoKeys, *keyURI)
+		opts := []v1.Option{
+			v1.WithDecryptKeyURIs(splitList(*decryptKeyURIs)...),
+			v1.WithAdditionalAuthenticatedData([]byte(*aad)),
+			v1.WithBackoff(backoff),
+			v1.WithCircuitBreaker(breaker),
+		}
+		if *decryptNoAAD {
+			opts = append(opts, v1.WithDecryptWithoutAAD())
+		}
+		p = v1.NewPlugin(kms.Projects.Locations.KeyRings.CryptoKeys, *keyURI, opts...)
 		healthChecker = v1.NewHealthChecker()
 		glog.Info("Kubernetes KMS API v1beta1")
 	case "v2":
-		p = v2.NewPlugin(kms.Projects.Locations.KeyRings.CryptoKeys, *keyURI, *keySuffix)
-		healthChecker = v2.NewHealthChecker()
+		var healthCheckerOptions []v2.HealthCheckerOption
+		if *healthzKeyID {
+			healthCheckerOptions = append(healthCheckerOptions, v2.WithKeyIDCheck())
+		}
+		if *keyType == "asymmetric" {
+			p = v2.NewAsymmetricPlugin(kms.Projects.Locations.KeyRings.CryptoKeys, *keyURI, *keySuffix, v2.WithAsymmetricBackoff(backoff), v2.WithAsymmetricCircuitBreaker(breaker))
+			healthChecker = v2.NewHealthChecker(healthCheckerOptions...)
+			glog.Info("Kubernetes KMS API v2 with an asymmetric key")
+			break
+		}
+		opts := []v2.Option{
+			v2.WithDecryptKeyURIs(splitList(*decryptKeyURIs)...),
+			v2.WithAdditionalAuthenticatedData([]byte(*aad)),
+			v2.WithReplicaKeyURIs(splitList(*replicaKeyURIs)...),
+			v2.WithMinReplicaCopies(*minReplicaCopies),
+			v2.WithBackoff(backoff),
+			v2.WithCircuitBreaker(breaker),
+		}
+		if *localEncryption {
+			opts = append(opts, v2.WithLocalEncryption(*dekLifetime))
+		}
+		if *decryptCacheSize > 0 {
+			opts = append(opts, v2.WithDecryptCache(*decryptCacheSize, *decryptCacheTTL))
+		}
+		if *keyPollInterval > 0 {
+			opts = append(opts, v2.WithKeyVersionPolling(*keyPollInterval, *healthzTimeout))
+		}
+		v2Plugin = v2.NewPlugin(kms.Projects.Locations.KeyRings.CryptoKeys, *keyURI, *keySuffix, opts...)
+		go v2Plugin.PollKeyVersion(ctx)
+		p = v2Plugin
+		healthChecker = v2.NewHealthChecker(healthCheckerOptions...)
 		glog.Info("Kubernetes KMS API v2")
 	default:
 		glog.Exitf("invalid value %q for --kms", *kmsVersion)
 	}
 
-	hc := plugin.NewHealthChecker(healthChecker, *keyURI, kms.Projects.Locations.KeyRings.CryptoKeys, *pathToUnixSocket, *healthzTimeout, &url.URL{
-		Host: fmt.Sprintf("localhost:%d", *healthzPort),
+	// IAM policies are set on crypto keys, not on the key version used in asymmetric mode.
+	iamResource, _, _ := strings.Cut(*keyURI, "/cryptoKeyVersions/")
+	hc := plugin.NewHealthChecker(healthChecker, iamResource, kms.Projects.Locations.KeyRings.CryptoKeys, *pathToUnixSocket, *healthzTimeout, &url.URL{
+		Host: net.JoinHostPort(*healthzAddress, strconv.Itoa(*healthzPort)),
 		Path: *healthzPath,
 	})
+	if *healthzTLSCertFile != "" {
+		tlsConfig, err := plugin.NewTLSConfig(*healthzTLSCertFile, *healthzTLSKeyFile, *healthzTLSClientCAFile)
+		if err != nil {
+			glog.Exitf("failed to load the TLS certificate of healthz: %v", err)
+		}
+		hc.SetTLSConfig(tlsConfig)
+	}
+	if *keyPollInterval > 0 || *healthzKeyState || *rotationCheckInterval > 0 {
+		hc.SetIAMPermissions("cloudkms.cryptoKeyVersions.useToEncrypt", "cloudkms.cryptoKeyVersions.useToDecrypt", "cloudkms.cryptoKeys.get")
+	}
+	if *keyType == "asymmetric" {
+		hc.SetIAMPermissions("cloudkms.cryptoKeyVersions.viewPublicKey", "cloudkms.cryptoKeyVersions.useToDecrypt")
+	}
+
+	hc.SetCircuitBreaker(breaker)
+	hc.SetCheckInterval(*healthzCheckInterval)
+	hc.SetKeyStateCheck(*healthzKeyState)
+
+	var rotation *plugin.RotationMonitor
+	if *rotationCheckInterval > 0 {
+		rotation = plugin.NewRotationMonitor(kms.Projects.Locations.KeyRings.CryptoKeys, *keyURI, *rotationMaxAge, *rotationCheckInterval, *healthzTimeout)
+		go rotation.Run(ctx)
+		if *rotationFailHealthz {
+			hc.SetRotationMonitor(rotation)
+		}
+	}
 
 	pluginManager := plugin.NewManager(p, *pathToUnixSocket)
+	pluginManager.SetLimits(plugin.Limits{
+		MaxConcurrency: *maxConcurrency,
+		RateLimit:      *rateLimit,
+		RateBurst:      *rateBurst,
+	})
+
+	// SIGHUP terminates the plugin unless there is a configuration to reload the key from.
+	var reload func() error
+	if *configPath != "" && v2Plugin != nil {
+		reload = func() error {
+			uri, suffix, err := reloadKey()
+			if err != nil {
+				return err
+			}
+
+			v2Plugin.SetKey(uri, suffix)
+			hc.SetKeyName(uri)
+			if rotation != nil {
+				rotation.SetKeyName(uri)
+			}
+			glog.Infof("Reloaded configuration, encrypting with %s and key suffix %q", uri, suffix)
+			return nil
+		}
+	}
 
-	glog.Exit(run(pluginManager, hc, metrics))
+	flushTraces := func(context.Context) error { return nil }
+	if *tracingEndpoint != "" {
+		flushTraces, err = plugin.SetupTracing(ctx, *tracingEndpoint, *tracingSamplingPerMill)
+		if err != nil {
+			glog.Exitf("failed to set up tracing: %v", err)
+		}
+	}
+
+	glog.Exit(run(pluginManager, hc, metrics, reload, flushTraces))
 }
 
-func run(pluginManager *plugin.PluginManager, h *plugin.HealthCheckerManager, m *plugin.Metrics) error {
+// run serves until the plugin fails or is signalled to stop. With a reload function, SIGHUP reloads the
+// configuration instead of terminating the plugin.
+func run(pluginManager *plugin.PluginManager, h *plugin.HealthCheckerManager, m *plugin.Metrics, reload func() error, flushTraces func(context.Context) error) error {
 	signalsChan := make(chan os.Signal, 1)
 	signal.Notify(signalsChan, syscall.SIGINT, syscall.SIGTERM)
+	var reloadChan chan os.Signal
+	if reload != nil {
+		reloadChan = make(chan os.Signal, 1)
+		signal.Notify(reloadChan, syscall.SIGHUP)
+	}
 
 	metricsErrCh := m.Serve()
 	healthzErrCh := h.Serve()
 
-	gRPCSrv, kmsErrorCh := pluginManager.Start()
-	defer gRPCSrv.GracefulStop()
+	_, kmsErrorCh := pluginManager.Start()
+	defer shutdown(pluginManager, h, m, flushTraces)
 
 	for {
 		select {
 		case sig := <-signalsChan:
 			return fmt.Errorf("captured %v, shutting down kms-plugin", sig)
+		case <-reloadChan:
+			if err := reload(); err != nil {
+				glog.Errorf("Failed to reload configuration, keeping the current one, error: %v", err)
+				plugin.ConfigReloadsTotal.WithLabelValues("failure").Inc()
+				continue
+			}
+			plugin.ConfigReloadsTotal.WithLabelValues("success").Inc()
 		case kmsError := <-kmsErrorCh:
 			return kmsError
 		case metricsErr := <-metricsErrCh:
@@ -146,10 +330,109 @@ func run(pluginManager *plugin.PluginManager, h *plugin.HealthCheckerManager, m
 	}
 }
 
+// shutdown fails healthz, drains the requests in flight for up to --shutdown-grace-period and then stops
+// the healthz and metrics servers and exports the spans not exported yet.
+func shutdown(pluginManager *plugin.PluginManager, h *plugin.HealthCheckerManager, m *plugin.Metrics, flushTraces func(context.Context) error) {
+	glog.Infof("Shutting down kms-plugin, draining requests in flight for up to %v", *shutdownGracePeriod)
+	h.SetShuttingDown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownGracePeriod)
+	defer cancel()
+	pluginManager.Stop(ctx)
+
+	// The servers get a moment to answer requests in progress even when the grace period is over.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		glog.Warningf("Failed to shut down healthz server, error: %v", err)
+	}
+	if err := m.Shutdown(ctx); err != nil {
+		glog.Warningf("Failed to shut down metrics server, error: %v", err)
+	}
+	if err := flushTraces(ctx); err != nil {
+		glog.Warningf("Failed to export the remaining spans, error: %v", err)
+	}
+}
+
 func mustValidateFlags() {
 	if *kmsVersion == "v1" && *keySuffix != "" {
 		glog.Exitf("--key-suffix argument cannot be used in v1 mode (--kms=v1)")
 	}
+	if *kmsVersion == "v1" && *healthzKeyID {
+		glog.Exitf("--healthz-check-key-id argument cannot be used in v1 mode (--kms=v1)")
+	}
+	if *kmsVersion == "v1" && *localEncryption {
+		glog.Exitf("--local-encryption argument cannot be used in v1 mode (--kms=v1)")
+	}
+	switch *keyType {
+	case "symmetric":
+	case "asymmetric":
+		if *kmsVersion == "v1" {
+			glog.Exitf("--key-type=asymmetric cannot be used in v1 mode (--kms=v1)")
+		}
+		if !strings.Contains(*keyURI, "/cryptoKeyVersions/") {
+			glog.Exitf("--key-uri must be a key version (ex. .../cryptoKeys/my-key/cryptoKeyVersions/1) with --key-type=asymmetric")
+		}
+		if *localEncryption || *aad != "" || *decryptKeyURIs != "" || *replicaKeyURIs != "" || *keyPollInterval != 0 || *decryptCacheSize != 0 || *healthzKeyState || *rotationCheckInterval != 0 {
+			glog.Exitf("--local-encryption, --aad, --decrypt-key-uris, --replica-key-uris, --key-poll-interval, --decrypt-cache-size, --healthz-check-key-state and --key-rotation-check-interval cannot be used with --key-type=asymmetric")
+		}
+	default:
+		glog.Exitf("invalid value %q for --key-type", *keyType)
+	}
+	if *kmsVersion != "v1" && *decryptNoAAD {
+		glog.Exitf("--decrypt-without-aad argument can only be used in v1 mode (--kms=v1)")
+	}
+	if *kmsVersion == "v1" && *replicaKeyURIs != "" {
+		glog.Exitf("--replica-key-uris argument cannot be used in v1 mode (--kms=v1)")
+	}
+	if n := len(splitList(*replicaKeyURIs)); *minReplicaCopies < -1 || *minReplicaCopies > n {
+		glog.Exitf("--min-replica-copies must be -1 or between 0 and the number of --replica-key-uris (%d), got %d", n, *minReplicaCopies)
+	}
+	if *kmsVersion == "v1" && *keyPollInterval != 0 {
+		glog.Exitf("--key-poll-interval argument cannot be used in v1 mode (--kms=v1)")
+	}
+	if *kmsVersion == "v1" && *decryptCacheSize != 0 {
+		glog.Exitf("--decrypt-cache-size argument cannot be used in v1 mode (--kms=v1)")
+	}
+	if *decryptCacheSize < 0 || (*decryptCacheSize > 0 && *decryptCacheTTL <= 0) {
+		glog.Exitf("--decrypt-cache-size must not be negative and --decrypt-cache-ttl must be positive")
+	}
+	if *localEncryption && *dekLifetime <= 0 {
+		glog.Exitf("--dek-lifetime must be positive, got %v", *dekLifetime)
+	}
+	if *retryAttempts < 1 || *retryInitialBackoff <= 0 || *retryMaxBackoff < *retryInitialBackoff {
+		glog.Exitf("--retry-attempts must be at least 1 and --retry-max-backoff must not be less than a positive --retry-initial-backoff")
+	}
+	if *breakerThreshold < 0 || (*breakerThreshold > 0 && *breakerCooldown <= 0) {
+		glog.Exitf("--circuit-breaker-threshold must not be negative and --circuit-breaker-cooldown must be positive")
+	}
+	if *maxConcurrency < 0 || *rateLimit < 0 || *rateBurst < 1 {
+		glog.Exitf("--grpc-max-concurrency and --grpc-rate-limit must not be negative and --grpc-rate-burst must be at least 1")
+	}
+	if *rotationCheckInterval < 0 || *rotationMaxAge < 0 {
+		glog.Exitf("--key-rotation-check-interval and --key-rotation-max-age must not be negative")
+	}
+	if *rotationCheckInterval == 0 && (*rotationMaxAge != 0 || *rotationFailHealthz) {
+		glog.Exitf("--key-rotation-max-age and --key-rotation-fail-healthz require --key-rotation-check-interval")
+	}
+	if *rotationFailHealthz && *rotationMaxAge == 0 {
+		glog.Exitf("--key-rotation-fail-healthz requires --key-rotation-max-age")
+	}
+	if (*healthzTLSCertFile == "") != (*healthzTLSKeyFile == "") || (*healthzTLSClientCAFile != "" && *healthzTLSCertFile == "") {
+		glog.Exitf("--healthz-tls-cert-file and --healthz-tls-key-file must be set together, and --healthz-tls-client-ca-file requires them")
+	}
+	if (*metricsTLSCertFile == "") != (*metricsTLSKeyFile == "") || (*metricsTLSClientCAFile != "" && *metricsTLSCertFile == "") {
+		glog.Exitf("--metrics-tls-cert-file and --metrics-tls-key-file must be set together, and --metrics-tls-client-ca-file requires them")
+	}
+	if *healthzCheckInterval < 0 {
+		glog.Exitf("--healthz-check-interval must not be negative, got %v", *healthzCheckInterval)
+	}
+	if *shutdownGracePeriod < 0 {
+		glog.Exitf("--shutdown-grace-period must not be negative, got %v", *shutdownGracePeriod)
+	}
+	if *tracingSamplingPerMill < 0 || *tracingSamplingPerMill > 1000000 {
+		glog.Exitf("--tracing-sampling-rate-per-million must be between 0 and 1000000, got %d", *tracingSamplingPerMill)
+	}
 	glog.Infof("Checking socket path %q", *pathToUnixSocket)
 	socketDir := filepath.Dir(*pathToUnixSocket)
 	glog.Infof("Unix Socket directory is %q", socketDir)
@@ -158,3 +441,14 @@ func mustValidateFlags() {
 	}
 	glog.Infof("Communication between KUBE API and KMS Plugin containers will be via %q", *pathToUnixSocket)
 }
+
+// splitList splits a comma separated flag value, ignoring empty elements.
+func splitList(s string) []string {
+	var result []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
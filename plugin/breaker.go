@@ -0,0 +1,172 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// States of CircuitBreaker.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitBreaker fails Cloud KMS calls fast once threshold consecutive calls failed because Cloud KMS is
+// unavailable. After cooldown it lets a single probe through (half-open) and closes again once a probe succeeds.
+// A nil *CircuitBreaker lets all calls through.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker constructs a closed CircuitBreaker.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	b := &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+	b.setState(CircuitClosed)
+	return b
+}
+
+// State returns the current state of the breaker, a half-open breaker is reported as such once
+// the cooldown has passed even before it is probed.
+func (b *CircuitBreaker) State() string {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.cooldown {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+// allow reports whether a call may proceed, reserving the probe of a half-open breaker for the caller.
+func (b *CircuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return errCircuitOpen
+		}
+		b.setState(CircuitHalfOpen)
+		b.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if b.probing {
+			return errCircuitOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// record updates the breaker with the outcome of a call let through by allow.
+// Only errors showing Cloud KMS is unavailable count as failures, ex. a permission error proves it is reachable.
+func (b *CircuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	// A call cancelled by the caller tells nothing about Cloud KMS.
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if !isUnavailable(err) {
+		if b.state != CircuitClosed {
+			glog.Infof("Cloud KMS is reachable again, closing the circuit breaker")
+		}
+		b.failures = 0
+		b.setState(CircuitClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		if b.state != CircuitOpen {
+			glog.Warningf("Cloud KMS is unavailable after %d consecutive failures, opening the circuit breaker for %v, error: %v", b.failures, b.cooldown, err)
+		}
+		b.openedAt = time.Now()
+		b.setState(CircuitOpen)
+	}
+}
+
+func (b *CircuitBreaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	if b.state != "" {
+		CircuitBreakerState.WithLabelValues(b.state).Set(0)
+	}
+	CircuitBreakerState.WithLabelValues(state).Set(1)
+	b.state = state
+}
+
+var errCircuitOpen = status.Error(codes.Unavailable, "Cloud KMS is unavailable, circuit breaker is open")
+
+// IsCircuitOpen reports whether err was returned without calling Cloud KMS because the circuit breaker is open.
+func IsCircuitOpen(err error) bool {
+	return errors.Is(err, errCircuitOpen)
+}
+
+// Call makes the Cloud KMS call do through the circuit breaker cb, retrying it according to b.
+func Call[T any](ctx context.Context, operationType string, b Backoff, cb *CircuitBreaker, do func(...googleapi.CallOption) (T, error)) (T, error) {
+	if err := cb.allow(); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	start := time.Now()
+	resp, err := Retry(ctx, operationType, b, do)
+	cb.record(err)
+	recordCloudKMSCall(operationType, start, resp, err)
+	if keyVersion := cloudKMSKeyVersion(resp); keyVersion != "" {
+		trace.SpanFromContext(ctx).SetAttributes(cloudKMSVersionKey.String(keyVersion))
+	}
+	return resp, err
+}
+
+func isUnavailable(err error) bool {
+	return err != nil && (IsRetryable(err) || errors.Is(err, context.DeadlineExceeded))
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cooldown := 50 * time.Millisecond
+	cb := NewCircuitBreaker(2, cooldown)
+
+	calls := 0
+	call := func(err error) error {
+		_, gotErr := Call(ctx, "encrypt", Backoff{}, cb, func(...googleapi.CallOption) (string, error) {
+			calls++
+			return "", err
+		})
+		return gotErr
+	}
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	// Terminal errors prove Cloud KMS is reachable and do not count.
+	call(unavailable)
+	call(&googleapi.Error{Code: http.StatusForbidden})
+	call(unavailable)
+	if got := cb.State(); got != CircuitClosed {
+		t.Fatalf("Got state %q after non-consecutive failures, want %q", got, CircuitClosed)
+	}
+
+	call(unavailable)
+	if got := cb.State(); got != CircuitOpen {
+		t.Fatalf("Got state %q after consecutive failures, want %q", got, CircuitOpen)
+	}
+	calls = 0
+	if err := call(nil); !IsCircuitOpen(err) || calls != 0 {
+		t.Fatalf("Got %v after %d calls to Cloud KMS, want to fail fast", err, calls)
+	}
+
+	// A failed probe opens the breaker again.
+	time.Sleep(cooldown)
+	if got := cb.State(); got != CircuitHalfOpen {
+		t.Fatalf("Got state %q after the cooldown, want %q", got, CircuitHalfOpen)
+	}
+	if err := call(unavailable); IsCircuitOpen(err) || calls != 1 {
+		t.Fatalf("Got %v after %d calls to Cloud KMS, want the probe to reach Cloud KMS", err, calls)
+	}
+	if got := cb.State(); got != CircuitOpen {
+		t.Fatalf("Got state %q after a failed probe, want %q", got, CircuitOpen)
+	}
+
+	time.Sleep(cooldown)
+	if err := call(nil); err != nil {
+		t.Fatalf("Probe failed, error: %v", err)
+	}
+	if got := cb.State(); got != CircuitClosed {
+		t.Fatalf("Got state %q after a successful probe, want %q", got, CircuitClosed)
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	t.Parallel()
+
+	cb := NewCircuitBreaker(1, 0)
+	cb.allow()
+	cb.record(&googleapi.Error{Code: http.StatusServiceUnavailable})
+
+	if err := cb.allow(); err != nil {
+		t.Fatalf("Expected the probe to be let through, got %v", err)
+	}
+	if err := cb.allow(); !IsCircuitOpen(err) {
+		t.Fatalf("Got %v while the probe is in flight, want to fail fast", err)
+	}
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	var cb *CircuitBreaker
+	if err := cb.allow(); err != nil {
+		t.Fatalf("Expected a nil breaker to let calls through, got %v", err)
+	}
+	cb.record(&googleapi.Error{Code: http.StatusServiceUnavailable})
+	if got := cb.State(); got != CircuitClosed {
+		t.Fatalf("Got state %q, want %q", got, CircuitClosed)
+	}
+}
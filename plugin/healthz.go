@@ -15,7 +15,12 @@
 package plugin
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"context"
@@ -27,21 +32,49 @@ import (
 
 	"net"
 	"net/http"
+	"strings"
 
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 )
 
 // HealthCheckerManager types that encapsulates healthz functionality of kms-plugin.
-// The following health checks are performed:
-// 1. Getting version of the plugin - validates gRPC connectivity.
-// 2. Asserting that the caller has encrypt and decrypt permissions on the crypto key.
+// /livez only checks that the plugin serves gRPC on its socket, so that a liveness probe does not restart
+// a healthy plugin over a transient Cloud KMS error. /readyz (and the legacy healthz path) performs the
+// following health checks, each of which is also served on its own at /readyz/<check>:
+// 1. shutdown - the plugin is not shutting down.
+// 2. socket - the plugin serves gRPC on its socket.
+// 3. grpc - getting version (or status) of the plugin - validates gRPC connectivity.
+// 4. circuit-breaker - the circuit breaker around Cloud KMS is not open.
+// 5. iam - asserting that the caller has encrypt and decrypt permissions on the crypto key.
+// 6. key-state - the primary version of the crypto key is enabled, only with a key state check.
+// 7. rotation - the primary version is not older than the maximum age, only with a rotation monitor.
+// 8. kms - encrypting and decrypting a payload, only with ping-kms=true or at /readyz/kms.
+// With a check interval, the checks calling the plugin or Cloud KMS run in the background and requests
+// are answered from their latest results, so that the number of probes does not multiply Cloud KMS traffic.
 type HealthCheckerManager struct {
-	keyName        string
+	keyName        atomic.Pointer[string]
 	KeyService     *kmspb.ProjectsLocationsKeyRingsCryptoKeysService
 	unixSocketPath string
 	callTimeout    time.Duration
 	servingURL     *url.URL
+	permissions    []string
+	breaker        *CircuitBreaker
+	keyStateCheck  bool
+	rotation       *RotationMonitor
+	tlsConfig      *tls.Config
+	server         *http.Server
+	// shuttingDown makes healthz fail, so that no new requests are sent to a plugin that is shutting down.
+	shuttingDown atomic.Bool
+
+	checkInterval time.Duration
+	stopChecks    context.CancelFunc
+	resultsLock   sync.Mutex
+	results       map[string]checkResult
+	// kmsRequestedAt is when the kms check was last requested, in Unix nanoseconds. It is also run in the
+	// background until it has not been requested for a while, so that Cloud KMS is not called for nobody.
+	kmsRequestedAt atomic.Int64
 
 	plugin HealthChecker
 }
@@ -54,89 +87,529 @@ type HealthChecker interface {
 func NewHealthChecker(plugin HealthChecker, keyName string, keyService *kmspb.ProjectsLocationsKeyRingsCryptoKeysService,
 	unixSocketPath string, callTimeout time.Duration, servingURL *url.URL) *HealthCheckerManager {
 
-	return &HealthCheckerManager{
-		keyName:        keyName,
+	m := &HealthCheckerManager{
 		KeyService:     keyService,
 		unixSocketPath: unixSocketPath,
 		callTimeout:    callTimeout,
 		servingURL:     servingURL,
-		plugin:         plugin,
+		permissions: []string{
+			"cloudkms.cryptoKeyVersions.useToEncrypt",
+			"cloudkms.cryptoKeyVersions.useToDecrypt",
+		},
+		results: make(map[string]checkResult),
+		plugin:  plugin,
 	}
+	m.SetKeyName(keyName)
+	return m
+}
+
+// SetKeyName changes the crypto key whose IAM permissions are asserted, ex. on a configuration reload.
+func (m *HealthCheckerManager) SetKeyName(keyName string) {
+	m.keyName.Store(&keyName)
+}
+
+// SetIAMPermissions overrides the permissions on the crypto key that TestIAMPermissions asserts,
+// by default these are the permissions to encrypt and decrypt.
+func (m *HealthCheckerManager) SetIAMPermissions(permissions ...string) {
+	m.permissions = permissions
+}
+
+// SetCircuitBreaker makes healthz fail while cb is open, so that it is apparent the plugin is shedding load.
+func (m *HealthCheckerManager) SetCircuitBreaker(cb *CircuitBreaker) {
+	m.breaker = cb
+}
+
+// SetKeyStateCheck adds the key-state check, which reads the crypto key with CryptoKeys.Get and fails
+// unless its primary version is enabled. It requires the cloudkms.cryptoKeys.get permission.
+func (m *HealthCheckerManager) SetKeyStateCheck(enabled bool) {
+	m.keyStateCheck = enabled
+}
+
+// SetRotationMonitor adds the rotation check, which fails while r finds the primary version older than
+// its maximum age.
+func (m *HealthCheckerManager) SetRotationMonitor(r *RotationMonitor) {
+	m.rotation = r
+}
+
+// SetTLSConfig makes healthz be served over HTTPS.
+func (m *HealthCheckerManager) SetTLSConfig(c *tls.Config) {
+	m.tlsConfig = c
+}
+
+// SetShuttingDown makes healthz and /readyz report the plugin as not ready for the rest of its life,
+// while /livez keeps reporting it alive so that it is not restarted while draining requests.
+func (m *HealthCheckerManager) SetShuttingDown() {
+	m.shuttingDown.Store(true)
+}
+
+// SetCheckInterval makes the checks run every interval in the background once served, rather than on
+// every request. Requests are answered from the latest results, which are reported as failed once they
+// are more than two intervals old.
+func (m *HealthCheckerManager) SetCheckInterval(interval time.Duration) {
+	m.checkInterval = interval
 }
 
 // Serve creates http server for hosting healthz.
 func (m *HealthCheckerManager) Serve() chan error {
 	errorCh := make(chan error)
 	mux := http.NewServeMux()
-	mux.HandleFunc(fmt.Sprintf("/%s", m.servingURL.EscapedPath()), m.HandlerFunc)
+	if path := fmt.Sprintf("/%s", m.servingURL.EscapedPath()); path != "/livez" && path != "/readyz" {
+		mux.HandleFunc(path, m.HandlerFunc)
+	}
+	mux.HandleFunc("/livez", m.LivezHandlerFunc)
+	mux.HandleFunc("/livez/", m.LivezHandlerFunc)
+	mux.HandleFunc("/readyz", m.HandlerFunc)
+	mux.HandleFunc("/readyz/", m.HandlerFunc)
+	m.server = &http.Server{Addr: m.servingURL.Host, Handler: mux, TLSConfig: m.tlsConfig}
+
+	if m.checkInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		m.stopChecks = cancel
+		go m.checkInBackground(ctx)
+	}
 
 	go func() {
 		defer close(errorCh)
 		glog.Infof("Registering healthz listener at %v", m.servingURL)
-		select {
-		case errorCh <- http.ListenAndServe(m.servingURL.Host, mux):
-		default:
+		if err := listenAndServe(m.server); !errors.Is(err, http.ErrServerClosed) {
+			select {
+			case errorCh <- err:
+			default:
+			}
 		}
 	}()
 
 	return errorCh
 }
 
+// Shutdown stops the background checks and the healthz server, waiting for the checks in progress until
+// ctx is done.
+func (m *HealthCheckerManager) Shutdown(ctx context.Context) error {
+	if m.stopChecks != nil {
+		m.stopChecks()
+	}
+	if m.server == nil {
+		return nil
+	}
+	return m.server.Shutdown(ctx)
+}
+
+// healthCheck is a named health check, served on its own at /livez/<name> or /readyz/<name>.
+type healthCheck struct {
+	name string
+	// status is the HTTP status code reported when the check fails.
+	status int
+	// local checks only read the state of the plugin, they are run on every request even with a check interval.
+	local bool
+	run   func(ctx context.Context, conn *grpc.ClientConn) error
+	// describe, when set, is run instead of run to also report details of what was checked.
+	describe func(ctx context.Context, conn *grpc.ClientConn) (string, error)
+}
+
+// checkResult is the outcome of running a healthCheck.
+type checkResult struct {
+	name      string
+	status    int
+	err       error
+	detail    string
+	checkedAt time.Time
+	duration  time.Duration
+	// lastSuccess is when the check last passed, it is only tracked with a check interval.
+	lastSuccess time.Time
+}
+
+func (m *HealthCheckerManager) livezChecks() []healthCheck {
+	return []healthCheck{
+		{name: "socket", status: http.StatusServiceUnavailable, run: m.checkSocket},
+	}
+}
+
+// readyzChecks lists the checks of /readyz, the kms check is only included when pingKMS is set.
+func (m *HealthCheckerManager) readyzChecks(pingKMS bool) []healthCheck {
+	checks := []healthCheck{
+		{name: "shutdown", status: http.StatusServiceUnavailable, local: true, run: m.checkShutdown},
+		{name: "socket", status: http.StatusServiceUnavailable, run: m.checkSocket},
+		{name: "grpc", status: http.StatusServiceUnavailable, run: m.plugin.PingRPC},
+		{name: "circuit-breaker", status: http.StatusServiceUnavailable, local: true, run: m.checkCircuitBreaker},
+		{name: "iam", status: http.StatusForbidden, run: func(ctx context.Context, _ *grpc.ClientConn) error {
+			return m.TestIAMPermissions(ctx)
+		}},
+	}
+	if m.keyStateCheck {
+		checks = append(checks, healthCheck{name: "key-state", status: http.StatusServiceUnavailable, describe: m.checkKeyState})
+	}
+	if m.rotation != nil {
+		checks = append(checks, healthCheck{name: "rotation", status: http.StatusServiceUnavailable, local: true, run: func(context.Context, *grpc.ClientConn) error {
+			return m.rotation.Err()
+		}})
+	}
+	if pingKMS {
+		checks = append(checks, healthCheck{name: "kms", status: http.StatusServiceUnavailable, run: m.plugin.PingKMS})
+	}
+	return checks
+}
+
+// LivezHandlerFunc serves /livez and /livez/<check>.
+func (m *HealthCheckerManager) LivezHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	m.serveChecks(w, r, "/livez", m.livezChecks())
+}
+
+// HandlerFunc serves /readyz, /readyz/<check> and the healthz path.
 func (m *HealthCheckerManager) HandlerFunc(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), m.callTimeout)
-	defer cancel()
+	m.serveChecks(w, r, "/readyz", m.readyzChecks(r.FormValue("ping-kms") == "true"))
+}
 
-	conn, err := dialUnix(m.unixSocketPath)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
+// serveChecks runs checks, or only the check named by the path under prefix, and reports the first
+// failure's status code. Every check is run even after a failure, so that the response shows all of them.
+// The result of every check, rather than "ok", is reported with ?verbose, and as JSON with ?format=json.
+func (m *HealthCheckerManager) serveChecks(w http.ResponseWriter, r *http.Request, prefix string, checks []healthCheck) {
+	if name, ok := strings.CutPrefix(r.URL.Path, prefix+"/"); ok {
+		checks = m.lookupCheck(prefix, name)
+		if checks == nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	var results []checkResult
+	if m.checkInterval > 0 {
+		results = m.cachedResults(r.Context(), checks)
+	} else {
+		results = m.runChecks(r.Context(), checks)
 	}
-	defer conn.Close()
 
-	if err := m.plugin.PingRPC(ctx, conn); err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	status := http.StatusOK
+	for _, res := range results {
+		if res.err != nil {
+			status = res.status
+			break
+		}
+	}
+
+	_, verbose := r.URL.Query()["verbose"]
+	switch {
+	case r.FormValue("format") == "json":
+		m.writeJSONReport(w, status, results)
+	case verbose || status != http.StatusOK:
+		m.writeReport(w, status, strings.TrimPrefix(prefix, "/"), results, verbose)
+	default:
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}
+}
+
+// writeReport writes a line per check, together with how long it took when verbose.
+func (m *HealthCheckerManager) writeReport(w http.ResponseWriter, status int, name string, results []checkResult, verbose bool) {
+	var report strings.Builder
+	for _, res := range results {
+		if res.err != nil {
+			fmt.Fprintf(&report, "[-]%s failed: %v", res.name, res.err)
+		} else {
+			fmt.Fprintf(&report, "[+]%s ok", res.name)
+		}
+		if verbose && res.detail != "" {
+			fmt.Fprintf(&report, ": %s", res.detail)
+		}
+
+		var details []string
+		if verbose {
+			details = append(details, fmt.Sprintf("took %v", res.duration.Truncate(time.Microsecond)))
+		}
+		if m.checkInterval > 0 {
+			details = append(details, describeAge(res))
+		}
+		if len(details) > 0 {
+			fmt.Fprintf(&report, " (%s)", strings.Join(details, ", "))
+		}
+		report.WriteString("\n")
+	}
+
+	if status != http.StatusOK {
+		fmt.Fprintf(&report, "%s check failed\n", name)
+		http.Error(w, report.String(), status)
 		return
 	}
+	fmt.Fprintf(&report, "%s check passed\n", name)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(report.String()))
+}
+
+// checkReport is a check in the report served with format=json.
+type checkReport struct {
+	Name        string     `json:"name"`
+	OK          bool       `json:"ok"`
+	Error       string     `json:"error,omitempty"`
+	Detail      string     `json:"detail,omitempty"`
+	Duration    string     `json:"duration"`
+	CheckedAt   time.Time  `json:"checkedAt"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+}
+
+// healthReport is the report served with format=json.
+type healthReport struct {
+	OK     bool          `json:"ok"`
+	Checks []checkReport `json:"checks"`
+}
 
-	if err := m.TestIAMPermissions(); err != nil {
-		http.Error(w, err.Error(), http.StatusForbidden)
+func (m *HealthCheckerManager) writeJSONReport(w http.ResponseWriter, status int, results []checkResult) {
+	report := healthReport{OK: status == http.StatusOK}
+	for _, res := range results {
+		c := checkReport{
+			Name:      res.name,
+			OK:        res.err == nil,
+			Detail:    res.detail,
+			Duration:  res.duration.Truncate(time.Microsecond).String(),
+			CheckedAt: res.checkedAt.UTC(),
+		}
+		if res.err != nil {
+			c.Error = res.err.Error()
+		}
+		if !res.lastSuccess.IsZero() {
+			lastSuccess := res.lastSuccess.UTC()
+			c.LastSuccess = &lastSuccess
+		}
+		report.Checks = append(report.Checks, c)
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// describeAge tells how old res is and, should it have failed, when the check last passed.
+func describeAge(res checkResult) string {
+	age := fmt.Sprintf("checked %v ago", time.Since(res.checkedAt).Truncate(time.Millisecond))
+	switch {
+	case res.err == nil:
+		return age
+	case res.lastSuccess.IsZero():
+		return age + ", never passed"
+	default:
+		return fmt.Sprintf("%s, last passed at %s", age, res.lastSuccess.UTC().Format(time.RFC3339))
+	}
+}
+
+// runChecks runs checks over a single connection to the plugin, within the healthz timeout.
+func (m *HealthCheckerManager) runChecks(ctx context.Context, checks []healthCheck) []checkResult {
+	ctx, cancel := context.WithTimeout(ctx, m.callTimeout)
+	defer cancel()
+
+	conn, dialErr := dialUnix(m.unixSocketPath)
+	if dialErr == nil {
+		defer conn.Close()
+	}
 
-	if r.FormValue("ping-kms") == "true" {
-		if err := m.plugin.PingKMS(ctx, conn); err != nil {
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	results := make([]checkResult, 0, len(checks))
+	for _, c := range checks {
+		start := time.Now()
+		var detail string
+		err := dialErr
+		switch {
+		case err != nil:
+		case c.describe != nil:
+			detail, err = c.describe(ctx, conn)
+		default:
+			err = c.run(ctx, conn)
+		}
+		if err == nil {
+			HealthCheckLastSuccessTimestamp.WithLabelValues(c.name).Set(float64(start.Unix()))
+		}
+		results = append(results, checkResult{name: c.name, status: c.status, err: err, detail: detail, checkedAt: start, duration: time.Since(start)})
+	}
+	return results
+}
+
+// checkInBackground runs the checks of /readyz, which include the checks of /livez, every check interval
+// until ctx is done.
+func (m *HealthCheckerManager) checkInBackground(ctx context.Context) {
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+	for {
+		var checks []healthCheck
+		for _, c := range m.readyzChecks(m.kmsRequestedRecently()) {
+			if !c.local {
+				checks = append(checks, c)
+			}
+		}
+		m.storeResults(m.runChecks(ctx, checks))
+
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
 		}
 	}
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("ok"))
+// staleAfter is how old the result of a check run in the background may get before it is reported as stale.
+func (m *HealthCheckerManager) staleAfter() time.Duration {
+	return 2*m.checkInterval + m.callTimeout
+}
+
+// kmsRequestedRecently reports whether the kms check was requested within staleAfter, in which case it is
+// run in the background.
+func (m *HealthCheckerManager) kmsRequestedRecently() bool {
+	return time.Since(time.Unix(0, m.kmsRequestedAt.Load())) <= m.staleAfter()
+}
+
+// cachedResults returns the latest results of checks from the background. Local checks, checks with no
+// result yet, and the kms check when it was not requested recently, are run on the spot.
+func (m *HealthCheckerManager) cachedResults(ctx context.Context, checks []healthCheck) []checkResult {
+	results := make([]checkResult, len(checks))
+	var pending []healthCheck
+	var pendingIdx []int
+
+	m.resultsLock.Lock()
+	for i, c := range checks {
+		res, ok := m.results[c.name]
+		if c.name == "kms" {
+			// The background stopped running the kms check once it lapsed, its result is outdated.
+			ok = ok && m.kmsRequestedRecently()
+			m.kmsRequestedAt.Store(time.Now().UnixNano())
+		}
+		if c.local || !ok {
+			pending = append(pending, c)
+			pendingIdx = append(pendingIdx, i)
+			continue
+		}
+		if age := time.Since(res.checkedAt); age > m.staleAfter() {
+			res.status = c.status
+			res.err = fmt.Errorf("result is stale, the check last ran %v ago", age.Truncate(time.Second))
+		}
+		results[i] = res
+	}
+	m.resultsLock.Unlock()
+
+	if len(pending) == 0 {
+		return results
+	}
+	ran := m.runChecks(ctx, pending)
+	for j, i := range pendingIdx {
+		if !pending[j].local {
+			m.storeResults(ran[j : j+1])
+		}
+		results[i] = ran[j]
+	}
+	return results
+}
+
+// storeResults records results as the latest ones, setting when each check last passed.
+func (m *HealthCheckerManager) storeResults(results []checkResult) {
+	m.resultsLock.Lock()
+	defer m.resultsLock.Unlock()
+	for i, res := range results {
+		if res.err == nil {
+			res.lastSuccess = res.checkedAt
+		} else {
+			res.lastSuccess = m.results[res.name].lastSuccess
+		}
+		results[i] = res
+		m.results[res.name] = res
+	}
+}
+
+// lookupCheck returns the check name under prefix, or nil if there is none.
+func (m *HealthCheckerManager) lookupCheck(prefix, name string) []healthCheck {
+	checks := m.livezChecks()
+	if prefix == "/readyz" {
+		checks = m.readyzChecks(true)
+	}
+	for _, c := range checks {
+		if c.name == name {
+			return []healthCheck{c}
+		}
+	}
+	return nil
+}
+
+func (m *HealthCheckerManager) checkShutdown(context.Context, *grpc.ClientConn) error {
+	if m.shuttingDown.Load() {
+		return errors.New("kms-plugin is shutting down")
+	}
+	return nil
+}
+
+// checkSocket waits until the gRPC connection over the socket is established, without calling the plugin.
+func (m *HealthCheckerManager) checkSocket(ctx context.Context, conn *grpc.ClientConn) error {
+	conn.Connect()
+	for state := conn.GetState(); state != connectivity.Ready; state = conn.GetState() {
+		if !conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("failed to connect to %s, last state %v: %w", m.unixSocketPath, state, ctx.Err())
+		}
+	}
+	return nil
+}
+
+func (m *HealthCheckerManager) checkCircuitBreaker(context.Context, *grpc.ClientConn) error {
+	if m.breaker.State() == CircuitOpen {
+		return errCircuitOpen
+	}
+	return nil
+}
+
+// checkKeyState reads the crypto key and describes its purpose, primary version, protection level and
+// rotation. It fails unless the primary version is enabled.
+func (m *HealthCheckerManager) checkKeyState(ctx context.Context, _ *grpc.ClientConn) (string, error) {
+	keyName := *m.keyName.Load()
+	key, err := m.KeyService.Get(keyName).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s, error: %w", keyName, err)
+	}
+	if key.Primary == nil {
+		return "", fmt.Errorf("key %s does not have a primary version", keyName)
+	}
+
+	primary := key.Primary
+	detail := fmt.Sprintf("purpose %s, primary version %s is %s, protection level %s", key.Purpose, primary.Name, primary.State, primary.ProtectionLevel)
+	if key.NextRotationTime != "" {
+		detail += ", next rotation at " + key.NextRotationTime
+	} else {
+		detail += ", no rotation scheduled"
+	}
+
+	switch primary.State {
+	case "ENABLED":
+		return detail, nil
+	case "DESTROY_SCHEDULED":
+		glog.Warningf("Primary version %s is scheduled for destruction at %s, data encrypted with it becomes unreadable then", primary.Name, primary.DestroyTime)
+		return detail, fmt.Errorf("primary version %s is scheduled for destruction at %s", primary.Name, primary.DestroyTime)
+	default:
+		return detail, fmt.Errorf("primary version %s is %s rather than ENABLED", primary.Name, primary.State)
+	}
 }
 
-func (h *HealthCheckerManager) TestIAMPermissions() error {
-	want := sets.NewString("cloudkms.cryptoKeyVersions.useToEncrypt", "cloudkms.cryptoKeyVersions.useToDecrypt")
+// TestIAMPermissions asserts that the plugin was granted the permissions it needs on the crypto key.
+// The call is bounded by ctx.
+func (h *HealthCheckerManager) TestIAMPermissions(ctx context.Context) error {
+	keyName := *h.keyName.Load()
+	want := sets.NewString(h.permissions...)
 	glog.Infof("Testing IAM permissions, want %v", want.List())
 
 	req := &kmspb.TestIamPermissionsRequest{
 		Permissions: want.List(),
 	}
 
-	resp, err := h.KeyService.TestIamPermissions(h.keyName, req).Do()
+	resp, err := h.KeyService.TestIamPermissions(keyName, req).Context(ctx).Do()
 	if err != nil {
-		return fmt.Errorf("failed to test IAM Permissions on %s, %v", h.keyName, err)
+		return fmt.Errorf("failed to test IAM Permissions on %s, %v", keyName, err)
 	}
-	glog.Infof("Got permissions: %v from CloudKMS for key:%s", resp.Permissions, h.keyName)
+	glog.Infof("Got permissions: %v from CloudKMS for key:%s", resp.Permissions, keyName)
 
 	got := sets.NewString(resp.Permissions...)
 	diff := want.Difference(got)
 
 	if diff.Len() != 0 {
-		glog.Errorf("Failed to validate IAM Permissions on %s, diff: %v", h.keyName, diff)
-		return fmt.Errorf("missing %v IAM permissions on CryptoKey:%s", diff, h.keyName)
+		glog.Errorf("Failed to validate IAM Permissions on %s, diff: %v", keyName, diff)
+		return fmt.Errorf("missing %v IAM permissions on CryptoKey:%s", diff, keyName)
 	}
 
-	glog.Infof("Successfully validated IAM Permissions on %s.", h.keyName)
+	glog.Infof("Successfully validated IAM Permissions on %s.", keyName)
 	return nil
 }
 
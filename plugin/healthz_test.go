@@ -0,0 +1,45 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKMSRequestedRecently(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		desc        string
+		requestedAt time.Time
+		want        bool
+	}{
+		{desc: "Never requested"},
+		{desc: "Requested within the check interval", requestedAt: time.Now().Add(-time.Second), want: true},
+		{desc: "Requested before the result went stale", requestedAt: time.Now().Add(-20 * time.Second), want: true},
+		{desc: "Lapsed", requestedAt: time.Now().Add(-time.Minute)},
+	}
+
+	for _, testCase := range testCases {
+		m := &HealthCheckerManager{checkInterval: 10 * time.Second, callTimeout: 5 * time.Second}
+		if !testCase.requestedAt.IsZero() {
+			m.kmsRequestedAt.Store(testCase.requestedAt.UnixNano())
+		}
+		if got := m.kmsRequestedRecently(); got != testCase.want {
+			t.Fatalf("%s: got %v, want %v", testCase.desc, got, testCase.want)
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"os"
 
 	"github.com/golang/glog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -67,7 +68,7 @@ func NewHTTPClient(ctx context.Context, pathToGCEConf string) (*http.Client, err
 			return nil, err
 		}
 
-		return oauth2.NewClient(ctx, a), nil
+		return withTracing(oauth2.NewClient(ctx, a)), nil
 	}
 
 	glog.Infof("Path to gce.conf was not supplied - assuming that need to rely on exported service account key.")
@@ -88,5 +89,12 @@ func getDefaultClient(ctx context.Context) (*http.Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to instantiate cloud sdk client: %v", err)
 	}
-	return client, nil
+	return withTracing(client), nil
+}
+
+// withTracing traces the requests of client to Cloud KMS as children of the span of the gRPC request
+// being served, and propagates the trace context to Cloud KMS.
+func withTracing(client *http.Client) *http.Client {
+	client.Transport = otelhttp.NewTransport(client.Transport)
+	return client
 }
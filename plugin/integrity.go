@@ -0,0 +1,114 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"encoding/base64"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CRC32C computes the checksum of data in the form expected by Cloud KMS.
+func CRC32C(data []byte) int64 {
+	return int64(crc32.Checksum(data, crc32cTable))
+}
+
+// NewEncryptRequest builds a Cloud KMS EncryptRequest carrying checksums of plaintext and aad,
+// so that Cloud KMS can detect corruption of the request in transit.
+func NewEncryptRequest(plaintext, aad []byte) *cloudkms.EncryptRequest {
+	return &cloudkms.EncryptRequest{
+		Plaintext:                         base64.StdEncoding.EncodeToString(plaintext),
+		PlaintextCrc32c:                   CRC32C(plaintext),
+		AdditionalAuthenticatedData:       base64.StdEncoding.EncodeToString(aad),
+		AdditionalAuthenticatedDataCrc32c: aadCRC32C(aad),
+		// The checksum of an empty plaintext is zero, which would otherwise be omitted.
+		ForceSendFields: []string{"PlaintextCrc32c"},
+	}
+}
+
+// NewDecryptRequest builds a Cloud KMS DecryptRequest carrying checksums of ciphertext and aad,
+// so that Cloud KMS can detect corruption of the request in transit.
+func NewDecryptRequest(ciphertext, aad []byte) *cloudkms.DecryptRequest {
+	return &cloudkms.DecryptRequest{
+		Ciphertext:                        base64.StdEncoding.EncodeToString(ciphertext),
+		CiphertextCrc32c:                  CRC32C(ciphertext),
+		AdditionalAuthenticatedData:       base64.StdEncoding.EncodeToString(aad),
+		AdditionalAuthenticatedDataCrc32c: aadCRC32C(aad),
+		ForceSendFields:                   []string{"CiphertextCrc32c"},
+	}
+}
+
+// VerifyEncryptResponse checks that Cloud KMS verified the checksums of the request and that
+// the returned ciphertext matches its checksum.
+func VerifyEncryptResponse(resp *cloudkms.EncryptResponse, ciphertext, aad []byte) error {
+	switch {
+	case !resp.VerifiedPlaintextCrc32c:
+		return NewIntegrityError("encrypt", "Cloud KMS did not verify the checksum of the plaintext")
+	case len(aad) != 0 && !resp.VerifiedAdditionalAuthenticatedDataCrc32c:
+		return NewIntegrityError("encrypt", "Cloud KMS did not verify the checksum of the additional authenticated data")
+	case resp.CiphertextCrc32c != CRC32C(ciphertext):
+		return NewIntegrityError("encrypt", "checksum of the ciphertext returned by Cloud KMS does not match")
+	}
+	return nil
+}
+
+// VerifyDecryptResponse checks that the plaintext returned by Cloud KMS matches its checksum.
+func VerifyDecryptResponse(resp *cloudkms.DecryptResponse, plaintext []byte) error {
+	if resp.PlaintextCrc32c != CRC32C(plaintext) {
+		return NewIntegrityError("decrypt", "checksum of the plaintext returned by Cloud KMS does not match")
+	}
+	return nil
+}
+
+// ConvertChecksumRejection returns a DataLoss error when Cloud KMS rejected a request of operationType
+// because a checksum it carries does not match the data, i.e. the request was corrupted in transit,
+// and err otherwise.
+func ConvertChecksumRejection(operationType string, err error) error {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+		return err
+	}
+	if !strings.Contains(strings.ToLower(apiErr.Message+apiErr.Body), "checksum") {
+		return err
+	}
+	return NewIntegrityError(operationType, "Cloud KMS rejected the checksum of the request: "+apiErr.Message)
+}
+
+// IsIntegrityError reports whether err was returned due to a checksum mismatch.
+func IsIntegrityError(err error) bool {
+	return status.Code(err) == codes.DataLoss
+}
+
+// NewIntegrityError records a checksum mismatch of operationType and returns it as a DataLoss error.
+func NewIntegrityError(operationType, msg string) error {
+	CloudKMSIntegrityFailuresTotal.WithLabelValues(operationType).Inc()
+	return status.Error(codes.DataLoss, msg)
+}
+
+func aadCRC32C(aad []byte) int64 {
+	if len(aad) == 0 {
+		return 0
+	}
+	return CRC32C(aad)
+}
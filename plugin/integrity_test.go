@@ -0,0 +1,135 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestVerifyEncryptResponse(t *testing.T) {
+	t.Parallel()
+
+	ciphertext := []byte("bar")
+	testCases := []struct {
+		desc    string
+		resp    *cloudkms.EncryptResponse
+		aad     []byte
+		wantErr bool
+	}{
+		{
+			desc: "Checksums verified",
+			resp: &cloudkms.EncryptResponse{
+				CiphertextCrc32c:        CRC32C(ciphertext),
+				VerifiedPlaintextCrc32c: true,
+			},
+		},
+		{
+			desc: "Plaintext checksum not verified by Cloud KMS",
+			resp: &cloudkms.EncryptResponse{
+				CiphertextCrc32c: CRC32C(ciphertext),
+			},
+			wantErr: true,
+		},
+		{
+			desc: "AAD checksum not verified by Cloud KMS",
+			resp: &cloudkms.EncryptResponse{
+				CiphertextCrc32c:        CRC32C(ciphertext),
+				VerifiedPlaintextCrc32c: true,
+			},
+			aad:     []byte("cluster-uid"),
+			wantErr: true,
+		},
+		{
+			desc: "Ciphertext corrupted in transit",
+			resp: &cloudkms.EncryptResponse{
+				CiphertextCrc32c:        CRC32C([]byte("baz")),
+				VerifiedPlaintextCrc32c: true,
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.desc, func(t *testing.T) {
+			err := VerifyEncryptResponse(testCase.resp, ciphertext, testCase.aad)
+			if gotErr := err != nil; gotErr != testCase.wantErr {
+				t.Fatalf("Got error %v, want error: %t", err, testCase.wantErr)
+			}
+			if err != nil && !IsIntegrityError(err) {
+				t.Fatalf("Got %v, want an integrity error", err)
+			}
+		})
+	}
+}
+
+func TestVerifyDecryptResponse(t *testing.T) {
+	t.Parallel()
+
+	plaintext := []byte("foo")
+	if err := VerifyDecryptResponse(&cloudkms.DecryptResponse{PlaintextCrc32c: CRC32C(plaintext)}, plaintext); err != nil {
+		t.Fatalf("Failed to verify a matching checksum, error: %v", err)
+	}
+	if err := VerifyDecryptResponse(&cloudkms.DecryptResponse{PlaintextCrc32c: CRC32C(plaintext)}, []byte("fooo")); !IsIntegrityError(err) {
+		t.Fatalf("Got %v, want an integrity error", err)
+	}
+}
+
+func TestConvertChecksumRejection(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		desc             string
+		err              error
+		wantIntegrityErr bool
+	}{
+		{
+			desc: "Checksum rejected by Cloud KMS",
+			err: &googleapi.Error{
+				Code:    http.StatusBadRequest,
+				Message: "The checksum in field ciphertext_crc32c did not match the data in field ciphertext.",
+			},
+			wantIntegrityErr: true,
+		},
+		{
+			desc: "Other invalid argument",
+			err: &googleapi.Error{
+				Code:    http.StatusBadRequest,
+				Message: "Decryption failed: the ciphertext is invalid.",
+			},
+		},
+		{
+			desc: "Unavailable",
+			err:  &googleapi.Error{Code: http.StatusServiceUnavailable},
+		},
+		{
+			desc: "Not a Cloud KMS error",
+			err:  errors.New("checksum"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.desc, func(t *testing.T) {
+			err := ConvertChecksumRejection("decrypt", testCase.err)
+			if got := IsIntegrityError(err); got != testCase.wantIntegrityErr {
+				t.Fatalf("Got integrity error %t for %v, want %t", got, err, testCase.wantIntegrityErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limits bounds the load the plugin's gRPC server puts on Cloud KMS, so that a runaway client
+// cannot exhaust the Cloud KMS quota of the project. The zero value sets no limits.
+type Limits struct {
+	// MaxConcurrency is the maximum number of requests served at once, 0 means unlimited.
+	MaxConcurrency int
+	// RateLimit is the number of requests per second allowed for each RPC method, 0 means unlimited.
+	RateLimit float64
+	// RateBurst is the number of requests of a method allowed at once on top of RateLimit.
+	RateBurst int
+}
+
+// interceptors returns the server interceptors enforcing l.
+func (l Limits) interceptors() []grpc.UnaryServerInterceptor {
+	var interceptors []grpc.UnaryServerInterceptor
+	if l.MaxConcurrency > 0 {
+		interceptors = append(interceptors, concurrencyLimit(l.MaxConcurrency))
+	}
+	if l.RateLimit > 0 {
+		interceptors = append(interceptors, rateLimit(l.RateLimit, l.RateBurst))
+	}
+	return interceptors
+}
+
+// concurrencyLimit rejects requests with codes.ResourceExhausted while limit requests are in flight.
+func concurrencyLimit(limit int) grpc.UnaryServerInterceptor {
+	slots := make(chan struct{}, limit)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			GRPCRejectedRequestsTotal.WithLabelValues(info.FullMethod, "concurrency").Inc()
+			return nil, status.Errorf(codes.ResourceExhausted, "%d requests are in flight already", limit)
+		}
+		defer func() { <-slots }()
+
+		return handler(ctx, req)
+	}
+}
+
+// rateLimit rejects requests with codes.ResourceExhausted once the token bucket of their method is empty.
+func rateLimit(rate float64, burst int) grpc.UnaryServerInterceptor {
+	var mu sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		mu.Lock()
+		b, ok := buckets[info.FullMethod]
+		if !ok {
+			b = newTokenBucket(rate, burst)
+			buckets[info.FullMethod] = b
+		}
+		mu.Unlock()
+
+		allowed, tokens := b.take(time.Now())
+		GRPCRateLimiterTokens.WithLabelValues(info.FullMethod).Set(tokens)
+		if !allowed {
+			GRPCRejectedRequestsTotal.WithLabelValues(info.FullMethod, "rate").Inc()
+			return nil, status.Errorf(codes.ResourceExhausted, "rate limit of %v requests per second exceeded for %s", rate, info.FullMethod)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// tokenBucket holds up to burst tokens and is refilled with rate tokens per second.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	// A bucket must hold at least one token for any request to pass.
+	b := max(float64(burst), 1)
+	return &tokenBucket{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		last:   time.Now(),
+	}
+}
+
+// take takes a token from the bucket if there is one and returns the tokens left.
+func (b *tokenBucket) take(now time.Time) (bool, float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false, b.tokens
+	}
+	b.tokens--
+	return true, b.tokens
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	b := newTokenBucket(2, 2)
+	now := b.last
+
+	testCases := []struct {
+		desc    string
+		elapsed time.Duration
+		want    bool
+	}{
+		{desc: "First token of the burst", want: true},
+		{desc: "Second token of the burst", want: true},
+		{desc: "Burst exhausted", want: false},
+		{desc: "Half a token refilled", elapsed: 250 * time.Millisecond, want: false},
+		{desc: "A token refilled", elapsed: 250 * time.Millisecond, want: true},
+		{desc: "Refill is capped by the burst", elapsed: time.Hour, want: true},
+		{desc: "Second token after the refill", want: true},
+		{desc: "Burst exhausted again", want: false},
+	}
+
+	for _, testCase := range testCases {
+		now = now.Add(testCase.elapsed)
+		if got, _ := b.take(now); got != testCase.want {
+			t.Fatalf("%s: got %t, want %t", testCase.desc, got, testCase.want)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	interceptor := rateLimit(0.001, 1)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	call := func(method string) error {
+		_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+
+	if err := call("/Encrypt"); err != nil {
+		t.Fatalf("Expected the first request to pass, got %v", err)
+	}
+	if err := call("/Encrypt"); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Got %v, want %v", err, codes.ResourceExhausted)
+	}
+	// Every method has its own bucket.
+	if err := call("/Decrypt"); err != nil {
+		t.Fatalf("Expected the first request of another method to pass, got %v", err)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	t.Parallel()
+
+	interceptor := concurrencyLimit(1)
+	info := &grpc.UnaryServerInfo{FullMethod: "/Decrypt"}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocking := func(ctx context.Context, req interface{}) (interface{}, error) {
+		close(started)
+		<-release
+		return "ok", nil
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := interceptor(context.Background(), nil, info, blocking)
+		done <- err
+	}()
+	<-started
+
+	if _, err := interceptor(context.Background(), nil, info, handler); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Got %v while a request is in flight, want %v", err, codes.ResourceExhausted)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Request in flight failed, error: %v", err)
+	}
+	if _, err := interceptor(context.Background(), nil, info, handler); err != nil {
+		t.Fatalf("Expected a request to pass once none is in flight, got %v", err)
+	}
+}
@@ -15,12 +15,20 @@
 package plugin
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/golang/glog"
+	kmspb "google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -29,9 +37,37 @@ import (
 // Metrics encapsulates functionality related to serving Prometheus metrics for kms-plugin.
 type Metrics struct {
 	ServingURL *url.URL
+	// TLSConfig, when set, makes the metrics be served over HTTPS.
+	TLSConfig *tls.Config
+
+	server *http.Server
 }
 
+// metricsNamespace prefixes the names of the metrics of the plugin.
+const metricsNamespace = "cloudkms_plugin"
+
 var (
+	CloudKMSRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "cloudkms_request_duration_seconds",
+			Help:      "Duration in seconds of Cloud KMS calls, retries included, by HTTP status code of the last attempt (none when there was no response) and key version.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		},
+		[]string{"operation_type", "http_status", "key_version"},
+	)
+
+	GRPCRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_request_duration_seconds",
+			Help:      "Duration in seconds of the gRPC requests served to kube-apiserver, by gRPC code and the key ID (key version and suffix) of the request or response.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		},
+		[]string{"method", "code", "key_version"},
+	)
+
+	// Deprecated: CloudKMSOperationalLatencies is only exported with legacy metrics, see CloudKMSRequestDuration.
 	CloudKMSOperationalLatencies = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name: "roundtrip_latencies",
@@ -42,6 +78,7 @@ var (
 		[]string{"operation_type"},
 	)
 
+	// Deprecated: CloudKMSOperationalFailuresTotal is only exported with legacy metrics, see CloudKMSRequestDuration.
 	CloudKMSOperationalFailuresTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "failures_count",
@@ -49,13 +86,153 @@ var (
 		},
 		[]string{"operation_type"},
 	)
+
+	CloudKMSIntegrityFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "integrity_failures_count",
+			Help: "Total number of kms operations that failed CRC32C checksum verification.",
+		},
+		[]string{"operation_type"},
+	)
+
+	CloudKMSRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "retries_count",
+			Help: "Total number of kms operations retried after a retryable failure.",
+		},
+		[]string{"operation_type"},
+	)
+
+	CircuitBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "circuit_breaker_state",
+			Help: "State of the circuit breaker around cloud kms, 1 for the current state and 0 otherwise.",
+		},
+		[]string{"state"},
+	)
+
+	FlightCoalescedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coalesced_requests_count",
+			Help: "Total number of requests that shared the result of an identical request in flight.",
+		},
+		[]string{"operation_type"},
+	)
+
+	GRPCInFlightRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "grpc_in_flight_requests",
+			Help: "Number of grpc requests being served, by method.",
+		},
+		[]string{"method"},
+	)
+
+	GRPCRateLimiterTokens = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "grpc_rate_limiter_tokens",
+			Help: "Tokens left in the rate limiter of a grpc method after its last request.",
+		},
+		[]string{"method"},
+	)
+
+	GRPCRejectedRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_rejected_requests_count",
+			Help: "Total number of grpc requests rejected with ResourceExhausted by the concurrency or the rate limit.",
+		},
+		[]string{"method", "limit"},
+	)
+
+	ConfigReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "config_reloads_count",
+			Help: "Total number of configuration reloads on SIGHUP by result, success or failure.",
+		},
+		[]string{"result"},
+	)
+
+	DecryptCacheHitsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "decrypt_cache_hits_count",
+			Help: "Total number of decrypt requests served from the decrypt cache.",
+		},
+	)
+
+	DecryptCacheMissesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "decrypt_cache_misses_count",
+			Help: "Total number of decrypt requests not found in the decrypt cache.",
+		},
+	)
+
+	KeyPrimaryVersionAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "key_primary_version_age_seconds",
+			Help: "Age of the primary version of the crypto key, as last read by the rotation monitor.",
+		},
+		[]string{"key"},
+	)
+
+	KeyNextRotationTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "key_next_rotation_timestamp_seconds",
+			Help: "Unix time at which the crypto key is next rotated, absent when no rotation is scheduled.",
+		},
+		[]string{"key"},
+	)
+
+	KeyRotationPeriod = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "key_rotation_period_seconds",
+			Help: "Rotation period of the crypto key, absent when the key is not rotated automatically.",
+		},
+		[]string{"key"},
+	)
+
+	HealthCheckLastSuccessTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "health_check_last_success_timestamp_seconds",
+			Help: "Unix time at which each health check last passed.",
+		},
+		[]string{"check"},
+	)
 )
 
+// prefixedMetrics are exported with the cloudkms_plugin_ prefix, and under their names without it with
+// legacy metrics.
+var prefixedMetrics = []prometheus.Collector{
+	CloudKMSIntegrityFailuresTotal,
+	CloudKMSRetriesTotal,
+	CircuitBreakerState,
+	FlightCoalescedTotal,
+	GRPCInFlightRequests,
+	GRPCRateLimiterTokens,
+	GRPCRejectedRequestsTotal,
+	ConfigReloadsTotal,
+	DecryptCacheHitsTotal,
+	DecryptCacheMissesTotal,
+	HealthCheckLastSuccessTimestamp,
+	KeyPrimaryVersionAge,
+	KeyNextRotationTimestamp,
+	KeyRotationPeriod,
+}
+
 func init() {
+	prometheus.MustRegister(CloudKMSRequestDuration)
+	prometheus.MustRegister(GRPCRequestDuration)
+	prometheus.WrapRegistererWithPrefix(metricsNamespace+"_", prometheus.DefaultRegisterer).MustRegister(prefixedMetrics...)
+}
+
+// RegisterLegacyMetrics exports the metrics under their names from before they were prefixed with
+// cloudkms_plugin_, together with roundtrip_latencies in milliseconds and failures_count, so that
+// dashboards built on them keep working. It must be called at most once.
+func RegisterLegacyMetrics() {
 	prometheus.MustRegister(CloudKMSOperationalLatencies)
 	prometheus.MustRegister(CloudKMSOperationalFailuresTotal)
+	prometheus.MustRegister(prefixedMetrics...)
 }
 
+// RecordCloudKMSOperation records the latency of a Cloud KMS operation in the legacy roundtrip_latencies.
 func RecordCloudKMSOperation(operationType string, start time.Time) {
 	CloudKMSOperationalLatencies.WithLabelValues(operationType).Observe(sinceInMilliseconds(start))
 }
@@ -64,17 +241,85 @@ func sinceInMilliseconds(start time.Time) float64 {
 	return float64(time.Since(start) / time.Millisecond)
 }
 
+// recordCloudKMSCall records the duration of a Cloud KMS call made by Call.
+func recordCloudKMSCall(operationType string, start time.Time, resp any, err error) {
+	httpStatus := "none"
+	var apiErr *googleapi.Error
+	switch {
+	case err == nil:
+		httpStatus = strconv.Itoa(http.StatusOK)
+	case errors.As(err, &apiErr):
+		httpStatus = strconv.Itoa(apiErr.Code)
+	}
+
+	CloudKMSRequestDuration.WithLabelValues(operationType, httpStatus, cloudKMSKeyVersion(resp)).Observe(time.Since(start).Seconds())
+}
+
+// cloudKMSKeyVersion returns the key version named by a Cloud KMS response. Only some responses name it,
+// Cloud KMS does not tell which version decrypted a payload. A failed call returns a nil response.
+func cloudKMSKeyVersion(resp any) string {
+	switch r := resp.(type) {
+	case *kmspb.EncryptResponse:
+		if r != nil {
+			return r.Name
+		}
+	case *kmspb.PublicKey:
+		if r != nil {
+			return r.Name
+		}
+	case *kmspb.CryptoKey:
+		if r != nil && r.Primary != nil {
+			return r.Primary.Name
+		}
+	}
+	return ""
+}
+
+// metricsInterceptor records the duration and code of every gRPC request, together with the key ID of
+// the request or response when there is one, and the requests in flight.
+func metricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	inFlight := GRPCInFlightRequests.WithLabelValues(info.FullMethod)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	type keyIDer interface {
+		GetKeyId() string
+	}
+	var keyID string
+	if r, ok := resp.(keyIDer); ok && err == nil {
+		keyID = r.GetKeyId()
+	} else if r, ok := req.(keyIDer); ok {
+		keyID = r.GetKeyId()
+	}
+	GRPCRequestDuration.WithLabelValues(info.FullMethod, status.Code(err).String(), keyID).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
 // Serve creates http server for hosting Prometheus metrics.
 func (m *Metrics) Serve() chan error {
 	errorChan := make(chan error)
 	mux := http.NewServeMux()
 	mux.Handle(fmt.Sprintf("/%s", m.ServingURL.EscapedPath()), promhttp.Handler())
+	m.server = &http.Server{Addr: m.ServingURL.Host, Handler: mux, TLSConfig: m.TLSConfig}
 
 	go func() {
 		defer close(errorChan)
-		glog.Infof("Registering Metrics listener on port %s", m.ServingURL.Port())
-		errorChan <- http.ListenAndServe(m.ServingURL.Host, mux)
+		glog.Infof("Registering Metrics listener on %s", m.ServingURL.Host)
+		if err := listenAndServe(m.server); !errors.Is(err, http.ErrServerClosed) {
+			errorChan <- err
+		}
 	}()
 
 	return errorChan
 }
+
+// Shutdown stops the metrics server, waiting for the scrapes in progress until ctx is done.
+func (m *Metrics) Shutdown(ctx context.Context) error {
+	if m.server == nil {
+		return nil
+	}
+	return m.server.Shutdown(ctx)
+}
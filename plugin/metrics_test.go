@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	kmspb "google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prometheuspb "github.com/prometheus/client_model/go"
+)
+
+func TestRecordCloudKMSCall(t *testing.T) {
+	t.Parallel()
+
+	const keyVersion = "projects/p/locations/l/keyRings/r/cryptoKeys/record-call/cryptoKeyVersions/1"
+
+	testCases := []struct {
+		desc           string
+		operationType  string
+		resp           any
+		err            error
+		wantHTTPStatus string
+		wantKeyVersion string
+	}{
+		{
+			desc:           "Encrypt names the key version",
+			operationType:  "record-encrypt",
+			resp:           &kmspb.EncryptResponse{Name: keyVersion},
+			wantHTTPStatus: "200",
+			wantKeyVersion: keyVersion,
+		},
+		{
+			desc:           "Status of a Cloud KMS error",
+			operationType:  "record-decrypt",
+			resp:           (*kmspb.EncryptResponse)(nil),
+			err:            &googleapi.Error{Code: http.StatusServiceUnavailable},
+			wantHTTPStatus: "503",
+		},
+		{
+			desc:           "No response",
+			operationType:  "record-status",
+			err:            errors.New("connection refused"),
+			wantHTTPStatus: "none",
+		},
+	}
+
+	for _, testCase := range testCases {
+		recordCloudKMSCall(testCase.operationType, time.Now(), testCase.resp, testCase.err)
+
+		observer, err := CloudKMSRequestDuration.GetMetricWithLabelValues(testCase.operationType, testCase.wantHTTPStatus, testCase.wantKeyVersion)
+		if err != nil {
+			t.Fatalf("%s: failed to get the metric, error: %v", testCase.desc, err)
+		}
+		if got := mustSampleCount(t, observer); got != 1 {
+			t.Fatalf("%s: got %d samples, want 1", testCase.desc, got)
+		}
+	}
+}
+
+func TestMetricsInterceptor(t *testing.T) {
+	t.Parallel()
+
+	const method = "/test.Metrics/Encrypt"
+	info := &grpc.UnaryServerInfo{FullMethod: method}
+	testCases := []struct {
+		desc      string
+		handler   grpc.UnaryHandler
+		wantCode  codes.Code
+		wantKeyID string
+	}{
+		{
+			desc: "Key ID of the response",
+			handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				return &kmsResponse{keyID: "response-key"}, nil
+			},
+			wantCode:  codes.OK,
+			wantKeyID: "response-key",
+		},
+		{
+			desc: "Key ID of the request on failure",
+			handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, status.Error(codes.Unavailable, "unavailable")
+			},
+			wantCode:  codes.Unavailable,
+			wantKeyID: "request-key",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if _, err := metricsInterceptor(context.Background(), &kmsResponse{keyID: "request-key"}, info, testCase.handler); status.Code(err) != testCase.wantCode {
+			t.Fatalf("%s: got code %v, want %v", testCase.desc, status.Code(err), testCase.wantCode)
+		}
+
+		observer, err := GRPCRequestDuration.GetMetricWithLabelValues(method, testCase.wantCode.String(), testCase.wantKeyID)
+		if err != nil {
+			t.Fatalf("%s: failed to get the metric, error: %v", testCase.desc, err)
+		}
+		if got := mustSampleCount(t, observer); got != 1 {
+			t.Fatalf("%s: got %d samples, want 1", testCase.desc, got)
+		}
+	}
+
+	m := &prometheuspb.Metric{}
+	if err := GRPCInFlightRequests.WithLabelValues(method).Write(m); err != nil {
+		t.Fatalf("Failed to read the in flight metric, error: %v", err)
+	}
+	if got := m.GetGauge().GetValue(); got != 0 {
+		t.Fatalf("Got %v requests in flight, want 0", got)
+	}
+}
+
+type kmsResponse struct {
+	keyID string
+}
+
+func (r *kmsResponse) GetKeyId() string {
+	return r.keyID
+}
+
+func mustSampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+
+	m := &prometheuspb.Metric{}
+	if err := observer.(prometheus.Metric).Write(m); err != nil {
+		t.Fatalf("Failed to read the histogram, error: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
@@ -16,12 +16,14 @@
 package plugin
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"strings"
 
 	"github.com/golang/glog"
+	"go.opentelemetry.io/otel"
 	"google.golang.org/grpc"
 )
 
@@ -42,6 +44,7 @@ type PluginManager struct {
 	server *grpc.Server
 
 	plugin Plugin
+	limits Limits
 }
 
 // NewManager creates a new plugin manager.
@@ -52,6 +55,12 @@ func NewManager(plugin Plugin, unixSocketFilePath string) *PluginManager {
 	}
 }
 
+// SetLimits sets the concurrency and rate limits enforced by the gRPC server, requests over the limits
+// are rejected with codes.ResourceExhausted. It must be called before Start.
+func (m *PluginManager) SetLimits(l Limits) {
+	m.limits = l
+}
+
 // ServeKMSRequests starts gRPC server or dies.
 func (m *PluginManager) Start() (*grpc.Server, <-chan error) {
 	errCh := make(chan error, 1)
@@ -76,7 +85,11 @@ func (m *PluginManager) Start() (*grpc.Server, <-chan error) {
 	m.Listener = listener
 	glog.Infof("Listening on unix domain socket: %s", m.unixSocketFilePath)
 
-	m.server = grpc.NewServer()
+	// Errors are translated to gRPC status codes outside of the limits, which return status errors already,
+	// and recorded in metrics and spans once translated.
+	tracingInterceptor := newTracingInterceptor(otel.GetTracerProvider(), otel.GetTextMapPropagator())
+	interceptors := append([]grpc.UnaryServerInterceptor{tracingInterceptor, metricsInterceptor, statusInterceptor}, m.limits.interceptors()...)
+	m.server = grpc.NewServer(grpc.ChainUnaryInterceptor(interceptors...))
 	m.plugin.Register(m.server)
 
 	go func() {
@@ -87,6 +100,32 @@ func (m *PluginManager) Start() (*grpc.Server, <-chan error) {
 	return m.server, errCh
 }
 
+// Stop stops accepting connections, removes the socket file and waits for the requests in flight until
+// ctx is done, at which point the remaining requests (and their Cloud KMS calls) are cancelled.
+func (m *PluginManager) Stop(ctx context.Context) {
+	if m.server == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.server.GracefulStop()
+	}()
+	if err := m.cleanSockFile(); err != nil {
+		glog.Warningf("Failed to clean up socket file, error: %v", err)
+	}
+
+	select {
+	case <-done:
+		glog.Infof("Drained requests in flight")
+	case <-ctx.Done():
+		glog.Warningf("Requests still in flight after the grace period, cancelling them")
+		m.server.Stop()
+		<-done
+	}
+}
+
 func (m *PluginManager) cleanSockFile() error {
 	// @ implies the use of Linux socket namespace - no file on disk and nothing to clean-up.
 	if strings.HasPrefix(m.unixSocketFilePath, "@") {
@@ -15,6 +15,7 @@
 package plugin
 
 import (
+	"context"
 	"errors"
 	"os"
 	"path/filepath"
@@ -22,6 +23,8 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type fakePlugin struct{}
@@ -76,3 +79,89 @@ func TestSocket(t *testing.T) {
 		t.Fatal("expected socket to be cleaned-up by now")
 	}
 }
+
+// slowPlugin serves the gRPC health service, blocking Check until release is closed or the call is cancelled.
+type slowPlugin struct {
+	healthpb.UnimplementedHealthServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *slowPlugin) Register(s *grpc.Server) {
+	healthpb.RegisterHealthServer(s, p)
+}
+
+func (p *slowPlugin) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	close(p.started)
+	select {
+	case <-p.release:
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestStop(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		desc        string
+		gracePeriod time.Duration
+		releaseIn   time.Duration
+		wantErr     bool
+	}{
+		{
+			desc:        "Request in flight is drained",
+			gracePeriod: 5 * time.Second,
+			releaseIn:   100 * time.Millisecond,
+		},
+		{
+			desc:        "Request in flight is cancelled after the grace period",
+			gracePeriod: 100 * time.Millisecond,
+			releaseIn:   time.Hour,
+			wantErr:     true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.desc, func(t *testing.T) {
+			t.Parallel()
+
+			f := filepath.Join(t.TempDir(), "listener.sock")
+			p := &slowPlugin{started: make(chan struct{}), release: make(chan struct{})}
+			pluginManager := NewManager(p, f)
+			if _, errCh := pluginManager.Start(); len(errCh) != 0 {
+				t.Fatal(<-errCh)
+			}
+
+			conn, err := grpc.NewClient("unix:"+f, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			callErr := make(chan error, 1)
+			go func() {
+				_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+				callErr <- err
+			}()
+			<-p.started
+			time.AfterFunc(testCase.releaseIn, func() { close(p.release) })
+
+			ctx, cancel := context.WithTimeout(context.Background(), testCase.gracePeriod)
+			defer cancel()
+			start := time.Now()
+			pluginManager.Stop(ctx)
+			if elapsed := time.Since(start); elapsed >= 5*time.Second {
+				t.Fatalf("Stop took %v, want it bounded by the grace period", elapsed)
+			}
+
+			if err := <-callErr; (err != nil) != testCase.wantErr {
+				t.Fatalf("Got error %v, want error %t", err, testCase.wantErr)
+			}
+			if _, err := os.Stat(f); err == nil {
+				t.Fatal("Expected socket to be cleaned-up by now")
+			}
+		})
+	}
+}
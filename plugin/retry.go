@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/api/googleapi"
+)
+
+// Backoff configures retries of Cloud KMS calls with jittered exponential backoff.
+// The zero value makes a single attempt.
+type Backoff struct {
+	// Attempts is the maximum number of calls, including the first one.
+	Attempts int
+	// Initial is the delay before the first retry, doubled before every subsequent retry up to Max.
+	Initial time.Duration
+	Max     time.Duration
+	// Jitter randomizes each delay by up to this fraction of it, so that plugins do not retry in lockstep.
+	Jitter float64
+}
+
+// delay returns the delay before the retry following attempt (counting from 1).
+func (b Backoff) delay(attempt int) time.Duration {
+	d := b.Initial
+	for i := 1; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter > 0 {
+		d += time.Duration(b.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// Retry makes the Cloud KMS call do, retrying retryable errors according to b until ctx is done.
+// Retries are counted in CloudKMSRetriesTotal under operationType.
+func Retry[T any](ctx context.Context, operationType string, b Backoff, do func(...googleapi.CallOption) (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := do()
+		if err == nil || attempt >= b.Attempts || ctx.Err() != nil || !IsRetryable(err) {
+			return resp, err
+		}
+
+		d := b.delay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+			// There is no point in waiting for a retry that cannot complete.
+			return resp, err
+		}
+		glog.V(4).Infof("Retrying %s in %v after attempt %d failed, error: %v", operationType, d, attempt, err)
+
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return resp, err
+		case <-t.C:
+		}
+		CloudKMSRetriesTotal.WithLabelValues(operationType).Inc()
+	}
+}
+
+// IsRetryable reports whether a Cloud KMS call that failed with err may succeed when retried:
+// rate limiting (429), server errors (5xx) and network errors are retryable, while other errors returned
+// by Cloud KMS (ex. 400, 403, 404) are terminal.
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsRetryable(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		desc string
+		err  error
+		want bool
+	}{
+		{desc: "Too many requests", err: &googleapi.Error{Code: http.StatusTooManyRequests}, want: true},
+		{desc: "Internal error", err: &googleapi.Error{Code: http.StatusInternalServerError}, want: true},
+		{desc: "Unavailable", err: &googleapi.Error{Code: http.StatusServiceUnavailable}, want: true},
+		{desc: "Bad request", err: &googleapi.Error{Code: http.StatusBadRequest}},
+		{desc: "Permission denied", err: &googleapi.Error{Code: http.StatusForbidden}},
+		{desc: "Not found", err: &googleapi.Error{Code: http.StatusNotFound}},
+		{desc: "Network error", err: &url.Error{Op: "Post", URL: "https://cloudkms.googleapis.com", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, want: true},
+		{desc: "Deadline exceeded", err: &url.Error{Op: "Post", URL: "https://cloudkms.googleapis.com", Err: context.DeadlineExceeded}},
+		{desc: "Integrity error", err: NewIntegrityError("encrypt", "checksum mismatch")},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.desc, func(t *testing.T) {
+			if got := IsRetryable(testCase.err); got != testCase.want {
+				t.Fatalf("IsRetryable(%v) = %t, want %t", testCase.err, got, testCase.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	backoff := Backoff{Attempts: 3, Initial: time.Millisecond, Max: 10 * time.Millisecond, Jitter: 0.2}
+	testCases := []struct {
+		desc         string
+		errs         []error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{
+			desc:         "Succeeds after retryable errors",
+			errs:         []error{&googleapi.Error{Code: http.StatusServiceUnavailable}, &googleapi.Error{Code: http.StatusTooManyRequests}, nil},
+			wantAttempts: 3,
+		},
+		{
+			desc:         "Gives up after the maximum number of attempts",
+			errs:         []error{&googleapi.Error{Code: http.StatusServiceUnavailable}, &googleapi.Error{Code: http.StatusServiceUnavailable}, &googleapi.Error{Code: http.StatusServiceUnavailable}, nil},
+			wantAttempts: 3,
+			wantErr:      true,
+		},
+		{
+			desc:         "Does not retry terminal errors",
+			errs:         []error{&googleapi.Error{Code: http.StatusForbidden}, nil},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.desc, func(t *testing.T) {
+			attempts := 0
+			do := func(...googleapi.CallOption) (string, error) {
+				err := testCase.errs[attempts]
+				attempts++
+				return fmt.Sprintf("attempt %d", attempts), err
+			}
+
+			_, err := Retry(context.Background(), "encrypt", backoff, do)
+			if gotErr := err != nil; gotErr != testCase.wantErr {
+				t.Fatalf("Got error %v, want error: %t", err, testCase.wantErr)
+			}
+			if attempts != testCase.wantAttempts {
+				t.Fatalf("Got %d attempts, want %d", attempts, testCase.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	do := func(...googleapi.CallOption) (string, error) {
+		attempts++
+		return "", &googleapi.Error{Code: http.StatusServiceUnavailable}
+	}
+
+	// The delay before the first retry exceeds the deadline, so waiting for it would be pointless.
+	start := time.Now()
+	if _, err := Retry(ctx, "encrypt", Backoff{Attempts: 3, Initial: time.Second, Max: time.Second}, do); err == nil {
+		t.Fatal("Expected Retry to fail")
+	}
+	if attempts != 1 || time.Since(start) >= 100*time.Millisecond {
+		t.Fatalf("Got %d attempts in %v, want one attempt without waiting for the deadline", attempts, time.Since(start))
+	}
+}
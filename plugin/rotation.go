@@ -0,0 +1,145 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	kmspb "google.golang.org/api/cloudkms/v1"
+)
+
+// RotationMonitor periodically reads the crypto key with CryptoKeys.Get and exports the age of its primary
+// version, its next rotation time and rotation period as metrics. With a maximum age, it warns once the
+// primary version is older, and reports it through Err so that healthz may fail.
+type RotationMonitor struct {
+	keyService *kmspb.ProjectsLocationsKeyRingsCryptoKeysService
+	keyName    atomic.Pointer[string]
+	maxAge     time.Duration
+	interval   time.Duration
+	timeout    time.Duration
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewRotationMonitor constructs a RotationMonitor for the crypto key keyName, checking it every interval
+// with each read bounded by timeout. A zero maxAge only exports the metrics.
+func NewRotationMonitor(keyService *kmspb.ProjectsLocationsKeyRingsCryptoKeysService, keyName string, maxAge, interval, timeout time.Duration) *RotationMonitor {
+	r := &RotationMonitor{
+		keyService: keyService,
+		maxAge:     maxAge,
+		interval:   interval,
+		timeout:    timeout,
+	}
+	r.SetKeyName(keyName)
+	return r
+}
+
+// SetKeyName changes the crypto key that is monitored, ex. on a configuration reload.
+func (r *RotationMonitor) SetKeyName(keyName string) {
+	r.keyName.Store(&keyName)
+}
+
+// Err returns the violation of the maximum age found by the last check, if any. The last known result is
+// kept while Cloud KMS is not reachable.
+func (r *RotationMonitor) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Run checks the key every interval until ctx is done.
+func (r *RotationMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.check(ctx); err != nil {
+			glog.Warningf("Failed to check the rotation of %s, error: %v", *r.keyName.Load(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *RotationMonitor) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	keyName := *r.keyName.Load()
+	key, err := r.keyService.Get(keyName).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	if key.Primary == nil {
+		return fmt.Errorf("key %s does not have a primary version", keyName)
+	}
+
+	created, err := time.Parse(time.RFC3339Nano, key.Primary.CreateTime)
+	if err != nil {
+		return fmt.Errorf("failed to parse createTime %q of %s, error: %w", key.Primary.CreateTime, key.Primary.Name, err)
+	}
+	age := time.Since(created)
+
+	// A single key is monitored, the series of a key that was reloaded away from are dropped.
+	KeyPrimaryVersionAge.Reset()
+	KeyNextRotationTimestamp.Reset()
+	KeyRotationPeriod.Reset()
+	KeyPrimaryVersionAge.WithLabelValues(keyName).Set(age.Seconds())
+
+	var nextRotation time.Time
+	if key.NextRotationTime != "" {
+		if nextRotation, err = time.Parse(time.RFC3339Nano, key.NextRotationTime); err != nil {
+			return fmt.Errorf("failed to parse nextRotationTime %q of %s, error: %w", key.NextRotationTime, keyName, err)
+		}
+		KeyNextRotationTimestamp.WithLabelValues(keyName).Set(float64(nextRotation.Unix()))
+	}
+	if key.RotationPeriod != "" {
+		period, err := time.ParseDuration(key.RotationPeriod)
+		if err != nil {
+			return fmt.Errorf("failed to parse rotationPeriod %q of %s, error: %w", key.RotationPeriod, keyName, err)
+		}
+		KeyRotationPeriod.WithLabelValues(keyName).Set(period.Seconds())
+	}
+
+	if r.maxAge <= 0 {
+		return nil
+	}
+
+	var violation error
+	switch {
+	case age > r.maxAge:
+		violation = fmt.Errorf("primary version %s is %v old, older than the maximum of %v", key.Primary.Name, age.Truncate(time.Hour), r.maxAge)
+		glog.Warningf("Key %s is due for rotation: %v", keyName, violation)
+	case nextRotation.IsZero():
+		glog.Warningf("Key %s does not have a rotation scheduled, its primary version %s becomes older than the maximum of %v at %s", keyName, key.Primary.Name, r.maxAge, created.Add(r.maxAge).Format(time.RFC3339))
+	case nextRotation.After(created.Add(r.maxAge)):
+		glog.Warningf("Key %s is scheduled for rotation at %s, after its primary version %s becomes older than the maximum of %v", keyName, key.NextRotationTime, key.Primary.Name, r.maxAge)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = violation
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/testutils/fakekms"
+	prometheuspb "github.com/prometheus/client_model/go"
+)
+
+func TestRotationMonitor(t *testing.T) {
+	t.Parallel()
+
+	const keyName = "projects/my-project/locations/us-east1/keyRings/my-key-ring/cryptoKeys/my-key"
+	now := time.Now()
+	keyResponse := func(age time.Duration) *cloudkms.CryptoKey {
+		return &cloudkms.CryptoKey{
+			Name: keyName,
+			Primary: &cloudkms.CryptoKeyVersion{
+				Name:       keyName + "/cryptoKeyVersions/1",
+				State:      "ENABLED",
+				CreateTime: now.Add(-age).Format(time.RFC3339Nano),
+			},
+			NextRotationTime: now.Add(24 * time.Hour).Format(time.RFC3339),
+			RotationPeriod:   "31536000s",
+			ServerResponse: googleapi.ServerResponse{
+				HTTPStatusCode: http.StatusOK,
+			},
+		}
+	}
+	unavailableResponse := &cloudkms.CryptoKey{
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: http.StatusServiceUnavailable,
+		},
+	}
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyName, 0, 0, keyResponse(30*24*time.Hour), keyResponse(400*24*time.Hour), unavailableResponse)
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	t.Cleanup(fakeKMSSrv.Close)
+
+	kms, err := cloudkms.NewService(context.Background(), option.WithHTTPClient(fakeKMSSrv.Client()))
+	if err != nil {
+		t.Fatalf("Failed to instantiate cloud kms client, error: %v", err)
+	}
+	kms.BasePath = fakeKMSSrv.URL()
+	r := NewRotationMonitor(kms.Projects.Locations.KeyRings.CryptoKeys, keyName, 365*24*time.Hour, time.Hour, 5*time.Second)
+
+	testCases := []struct {
+		desc      string
+		wantAge   time.Duration
+		wantErr   bool
+		wantCheck bool
+	}{
+		{desc: "Primary version within the maximum age", wantAge: 30 * 24 * time.Hour, wantCheck: true},
+		{desc: "Primary version older than the maximum age", wantAge: 400 * 24 * time.Hour, wantErr: true, wantCheck: true},
+		{desc: "Last result is kept while Cloud KMS is not reachable", wantAge: 400 * 24 * time.Hour, wantErr: true},
+	}
+
+	for _, testCase := range testCases {
+		if err := r.check(context.Background()); (err == nil) != testCase.wantCheck {
+			t.Fatalf("%s: got check error %v, want error %v", testCase.desc, err, !testCase.wantCheck)
+		}
+		if err := r.Err(); (err != nil) != testCase.wantErr {
+			t.Fatalf("%s: got Err %v, want error %v", testCase.desc, err, testCase.wantErr)
+		}
+
+		m := &prometheuspb.Metric{}
+		if err := KeyPrimaryVersionAge.WithLabelValues(keyName).Write(m); err != nil {
+			t.Fatalf("%s: failed to read the age metric, error: %v", testCase.desc, err)
+		}
+		if got := time.Duration(m.GetGauge().GetValue() * float64(time.Second)); got < testCase.wantAge || got > testCase.wantAge+time.Minute {
+			t.Fatalf("%s: got age %v, want %v", testCase.desc, got, testCase.wantAge)
+		}
+	}
+
+	m := &prometheuspb.Metric{}
+	if err := KeyRotationPeriod.WithLabelValues(keyName).Write(m); err != nil {
+		t.Fatalf("Failed to read the rotation period metric, error: %v", err)
+	}
+	if got, want := m.GetGauge().GetValue(), (365 * 24 * time.Hour).Seconds(); got != want {
+		t.Fatalf("Got rotation period %v, want %v", got, want)
+	}
+}
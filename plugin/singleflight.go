@@ -0,0 +1,86 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Flight coalesces concurrent identical calls, ex. decrypting the same ciphertext, into one.
+// Unlike a cache it only holds on to a result until the callers waiting for it have received it.
+// The zero value is ready to use.
+type Flight struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done  chan struct{}
+	plain []byte
+	err   error
+
+	// span is the span of the caller making the call, which the Cloud KMS calls are traced under.
+	span trace.SpanContext
+}
+
+// Do calls fn unless a call with the same key is in flight, in which case it waits for that call and
+// returns a copy of its result. A caller stops waiting once its own ctx is done, and calls fn itself
+// should the call it waited for be cancelled by its caller.
+// operationType labels the calls counted in FlightCoalescedTotal.
+func (f *Flight) Do(ctx context.Context, operationType, key string, fn func(context.Context) ([]byte, error)) ([]byte, error) {
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = make(map[string]*flightCall)
+	}
+	if c, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+		FlightCoalescedTotal.WithLabelValues(operationType).Inc()
+		trace.SpanFromContext(ctx).AddEvent("Waiting for a coalesced call", trace.WithAttributes(
+			coalescedTraceIDKey.String(c.span.TraceID().String()),
+			coalescedSpanIDKey.String(c.span.SpanID().String()),
+		))
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.done:
+		}
+		if isContextError(c.err) && ctx.Err() == nil {
+			return f.Do(ctx, operationType, key, fn)
+		}
+		return bytes.Clone(c.plain), c.err
+	}
+	c := &flightCall{done: make(chan struct{}), span: trace.SpanContextFromContext(ctx)}
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	c.plain, c.err = fn(ctx)
+
+	f.mu.Lock()
+	delete(f.calls, key)
+	f.mu.Unlock()
+	close(c.done)
+
+	return c.plain, c.err
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlight(t *testing.T) {
+	t.Parallel()
+
+	var f Flight
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := func(ctx context.Context) ([]byte, error) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-release:
+			return []byte("foo"), nil
+		}
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := f.Do(leaderCtx, "decrypt", "key", fn)
+		leaderErr <- err
+	}()
+	<-started
+
+	// A waiting caller gives up once its own context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := f.Do(ctx, "decrypt", "key", fn); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A waiting caller takes over once the call it waited for is cancelled.
+	followerResult := make(chan []byte, 1)
+	go func() {
+		plain, err := f.Do(context.Background(), "decrypt", "key", fn)
+		if err != nil {
+			t.Errorf("Failed to take over a cancelled call, error: %v", err)
+		}
+		followerResult <- plain
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancelLeader()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Got %v, want %v", err, context.Canceled)
+	}
+	close(release)
+
+	if got := <-followerResult; !bytes.Equal(got, []byte("foo")) {
+		t.Fatalf("Got %q, want %q", got, "foo")
+	}
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("Got %d calls, want 2", got)
+	}
+}
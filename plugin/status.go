@@ -0,0 +1,163 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cloudKMSDomain is the domain of the ErrorInfo details attached to errors returned by Cloud KMS.
+const cloudKMSDomain = "cloudkms.googleapis.com"
+
+var (
+	// ErrInvalidCiphertext is wrapped by the errors of payloads the plugin rejects itself as malformed or
+	// corrupt, reported with codes.InvalidArgument as retrying them cannot succeed.
+	ErrInvalidCiphertext = errors.New("invalid ciphertext")
+	// ErrAADMismatch is wrapped by the errors of payloads bound to other additional authenticated data than
+	// the plugin is configured with, reported with codes.FailedPrecondition.
+	ErrAADMismatch = errors.New("additional authenticated data mismatch")
+)
+
+// StatusError translates err into a gRPC status error with a code telling kube-apiserver (and alerting)
+// whether the call may succeed when retried, ex. a disabled key from a network blip.
+// Errors returned by Cloud KMS keep their HTTP status code and reason in an ErrorInfo detail.
+// Other errors that are gRPC status errors already, ex. integrity errors, are returned as is.
+func StatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// googleapi.Error is a gRPC status error too, with codes.Unknown when Cloud KMS answered over HTTP.
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(statusCode(err), err.Error())
+	}
+
+	reason := http.StatusText(apiErr.Code)
+	if len(apiErr.Errors) != 0 && apiErr.Errors[0].Reason != "" {
+		reason = apiErr.Errors[0].Reason
+	}
+	s, detailsErr := status.New(statusCode(err), err.Error()).WithDetails(&errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: cloudKMSDomain,
+		Metadata: map[string]string{
+			"httpStatusCode": strconv.Itoa(apiErr.Code),
+		},
+	})
+	if detailsErr != nil {
+		return status.Error(statusCode(err), err.Error())
+	}
+	return s.Err()
+}
+
+// IsKeyError reports whether err is terminal for the key a call was made with, ex. a ciphertext that was not
+// encrypted with it or a key version that is not enabled, rather than Cloud KMS being unavailable. Only then
+// may decryption fall back to another key, as other failures were already retried or failed fast.
+func IsKeyError(err error) bool {
+	switch status.Code(StatusError(err)) {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.NotFound:
+		return true
+	default:
+		return false
+	}
+}
+
+// statusCode returns the gRPC status code matching err.
+func statusCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, ErrInvalidCiphertext):
+		return codes.InvalidArgument
+	case errors.Is(err, ErrAADMismatch):
+		return codes.FailedPrecondition
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if c, ok := canonicalCode(apiErr); ok {
+			return c
+		}
+		switch {
+		case apiErr.Code == http.StatusBadRequest:
+			return codes.InvalidArgument
+		case apiErr.Code == http.StatusUnauthorized:
+			return codes.Unauthenticated
+		case apiErr.Code == http.StatusForbidden:
+			return codes.PermissionDenied
+		case apiErr.Code == http.StatusNotFound:
+			return codes.NotFound
+		case apiErr.Code == http.StatusConflict || apiErr.Code == http.StatusPreconditionFailed:
+			return codes.FailedPrecondition
+		case apiErr.Code == http.StatusTooManyRequests:
+			return codes.ResourceExhausted
+		case apiErr.Code == http.StatusGatewayTimeout:
+			return codes.DeadlineExceeded
+		case apiErr.Code >= http.StatusInternalServerError:
+			return codes.Unavailable
+		default:
+			return codes.Unknown
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return codes.DeadlineExceeded
+		}
+		return codes.Unavailable
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return codes.Unavailable
+	}
+	return codes.Unknown
+}
+
+// canonicalCode returns the canonical code Cloud KMS reports along with the HTTP status code, ex.
+// FAILED_PRECONDITION with 400 Bad Request for a key version that is not enabled.
+func canonicalCode(apiErr *googleapi.Error) (codes.Code, bool) {
+	var body struct {
+		Error struct {
+			Status *codes.Code `json:"status"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(apiErr.Body), &body); err != nil || body.Error.Status == nil {
+		return codes.Unknown, false
+	}
+	return *body.Error.Status, true
+}
+
+// statusInterceptor translates the errors returned by the plugin with StatusError.
+func statusInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	return resp, StatusError(err)
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStatusError(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		desc       string
+		err        error
+		want       codes.Code
+		wantReason string
+	}{
+		{
+			desc:       "Key disabled",
+			err:        &googleapi.Error{Code: http.StatusBadRequest, Errors: []googleapi.ErrorItem{{Reason: "failedPrecondition"}}},
+			want:       codes.InvalidArgument,
+			wantReason: "failedPrecondition",
+		},
+		{
+			desc: "Key version not enabled",
+			err: &googleapi.Error{
+				Code: http.StatusBadRequest,
+				Body: `{"error": {"code": 400, "message": "is not enabled, current state is: DISABLED.", "status": "FAILED_PRECONDITION"}}`,
+			},
+			want:       codes.FailedPrecondition,
+			wantReason: "Bad Request",
+		},
+		{
+			desc:       "Permission denied",
+			err:        fmt.Errorf("failed to encrypt, error: %w", &googleapi.Error{Code: http.StatusForbidden}),
+			want:       codes.PermissionDenied,
+			wantReason: "Forbidden",
+		},
+		{
+			desc:       "Key not found",
+			err:        &googleapi.Error{Code: http.StatusNotFound},
+			want:       codes.NotFound,
+			wantReason: "Not Found",
+		},
+		{
+			desc:       "Rate limited",
+			err:        &googleapi.Error{Code: http.StatusTooManyRequests},
+			want:       codes.ResourceExhausted,
+			wantReason: "Too Many Requests",
+		},
+		{
+			desc:       "Server error",
+			err:        &googleapi.Error{Code: http.StatusServiceUnavailable},
+			want:       codes.Unavailable,
+			wantReason: "Service Unavailable",
+		},
+		{
+			desc: "Deadline exceeded",
+			err:  fmt.Errorf("failed to decrypt, error: %w", context.DeadlineExceeded),
+			want: codes.DeadlineExceeded,
+		},
+		{
+			desc: "Network error",
+			err:  &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+			want: codes.Unavailable,
+		},
+		{
+			desc: "Integrity error is kept",
+			err:  NewIntegrityError("decrypt", "plaintext"),
+			want: codes.DataLoss,
+		},
+		{
+			desc: "Corrupt ciphertext",
+			err:  fmt.Errorf("%w: it is shorter than the nonce", ErrInvalidCiphertext),
+			want: codes.InvalidArgument,
+		},
+		{
+			desc: "Additional authenticated data mismatch",
+			err:  fmt.Errorf("%w: payload is bound to %q", ErrAADMismatch, "other-cluster"),
+			want: codes.FailedPrecondition,
+		},
+		{
+			desc: "Other error",
+			err:  errors.New("failed to decode from base64"),
+			want: codes.Unknown,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.desc, func(t *testing.T) {
+			t.Parallel()
+
+			s := status.Convert(StatusError(testCase.err))
+			if s.Code() != testCase.want {
+				t.Fatalf("Got %v, want %v", s.Code(), testCase.want)
+			}
+			if testCase.wantReason == "" {
+				return
+			}
+
+			var info *errdetails.ErrorInfo
+			for _, d := range s.Details() {
+				if i, ok := d.(*errdetails.ErrorInfo); ok {
+					info = i
+				}
+			}
+			if info == nil || info.Reason != testCase.wantReason || info.Domain != cloudKMSDomain {
+				t.Fatalf("Got ErrorInfo %v, want reason %q in domain %q", info, testCase.wantReason, cloudKMSDomain)
+			}
+		})
+	}
+}
+
+func TestIsKeyError(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		desc string
+		err  error
+		want bool
+	}{
+		{desc: "Ciphertext of another key", err: &googleapi.Error{Code: http.StatusBadRequest}, want: true},
+		{desc: "Key not found", err: &googleapi.Error{Code: http.StatusNotFound}, want: true},
+		{
+			desc: "Key version not enabled",
+			err: &googleapi.Error{
+				Code: http.StatusBadRequest,
+				Body: `{"error": {"code": 400, "status": "FAILED_PRECONDITION"}}`,
+			},
+			want: true,
+		},
+		{desc: "Quota exceeded", err: &googleapi.Error{Code: http.StatusTooManyRequests}},
+		{desc: "Unavailable", err: &googleapi.Error{Code: http.StatusServiceUnavailable}},
+		{desc: "Deadline exceeded", err: context.DeadlineExceeded},
+		{desc: "Circuit open", err: errCircuitOpen},
+	}
+
+	for _, testCase := range testCases {
+		if got := IsKeyError(testCase.err); got != testCase.want {
+			t.Fatalf("%s: got %v, want %v", testCase.desc, got, testCase.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for changes, at most once per handshake.
+const tlsReloadInterval = time.Second
+
+// NewTLSConfig constructs the TLS configuration of the healthz or metrics server from PEM files.
+// With clientCAFile, clients must present a certificate signed by one of its CAs.
+// The files are re-read once they change, so that rotated certificates are served without a restart.
+func NewTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	f := &tlsFiles{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	f.checkedAt = time.Now()
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// ListenAndServeTLS requires a certificate on the config, GetConfigForClient takes precedence.
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := f.current()
+			return cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := f.current()
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if clientCAs != nil {
+				c.ClientCAs = clientCAs
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}, nil
+}
+
+// listenAndServe serves srv over HTTPS when it has a TLS configuration, and over HTTP otherwise.
+func listenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		// The certificate comes from the configuration, which re-reads its files.
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+// tlsFiles holds the certificate and client CAs last read from their files.
+type tlsFiles struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	modTimes  [3]time.Time
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// current returns the certificate and client CAs, re-reading the files should they have changed since
+// they were last checked. The previous ones are kept when the new files cannot be read, ex. while a
+// certificate and its key are being replaced one after the other.
+func (f *tlsFiles) current() (*tls.Certificate, *x509.CertPool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.checkedAt) >= tlsReloadInterval {
+		f.checkedAt = time.Now()
+		if err := f.load(); err != nil {
+			glog.Warningf("Failed to reload TLS certificates, serving the previous ones, error: %v", err)
+		}
+	}
+	return f.cert, f.clientCAs
+}
+
+// load reads the files unless none of them changed since they were last read.
+func (f *tlsFiles) load() error {
+	var modTimes [3]time.Time
+	for i, name := range []string{f.certFile, f.keyFile, f.clientCAFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	if f.cert != nil && modTimes == f.modTimes {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the certificate %s and key %s, error: %w", f.certFile, f.keyFile, err)
+	}
+
+	var clientCAs *x509.CertPool
+	if f.clientCAFile != "" {
+		pem, err := os.ReadFile(f.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", f.clientCAFile)
+		}
+	}
+
+	if f.cert != nil {
+		glog.Infof("Reloaded TLS certificate %s", f.certFile)
+	}
+	f.cert, f.clientCAs, f.modTimes = &cert, clientCAs, modTimes
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/phayes/freeport"
+)
+
+func TestMetricsTLS(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ca, caKey := mustCreateCertificate(t, 1, nil, nil)
+	client, clientKey := mustCreateCertificate(t, 2, ca, caKey)
+	server, serverKey := mustCreateCertificate(t, 3, ca, caKey)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	mustWritePEM(t, caFile, ca, nil)
+	mustWritePEM(t, certFile, server, nil)
+	mustWritePEM(t, keyFile, nil, serverKey)
+
+	tlsConfig, err := NewTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("Failed to construct the TLS configuration, error: %v", err)
+	}
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to allocate a free port for metrics server, err: %v", err)
+	}
+	m := &Metrics{
+		ServingURL: &url.URL{Host: fmt.Sprintf("localhost:%d", port), Path: "metrics"},
+		TLSConfig:  tlsConfig,
+	}
+	errCh := m.Serve()
+	t.Cleanup(func() {
+		m.Shutdown(context.Background())
+	})
+	select {
+	case err := <-errCh:
+		t.Fatalf("Failed to serve metrics, error: %v", err)
+	case <-time.After(time.Second):
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	get := func(certs ...tls.Certificate) (*http.Response, error) {
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+		return c.Get(fmt.Sprintf("https://localhost:%d/metrics", port))
+	}
+	clientCert := tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}
+
+	if _, err := get(); err == nil {
+		t.Fatal("Got metrics without a client certificate, want the handshake to fail")
+	}
+	resp, err := get(clientCert)
+	if err != nil {
+		t.Fatalf("Failed to get metrics with a client certificate, error: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.TLS.PeerCertificates[0].SerialNumber; got.Cmp(server.SerialNumber) != 0 {
+		t.Fatalf("Got server certificate %v, want %v", got, server.SerialNumber)
+	}
+
+	// The rotated certificate is served once the files are checked again.
+	rotated, rotatedKey := mustCreateCertificate(t, 4, ca, caKey)
+	mustWritePEM(t, certFile, rotated, nil)
+	mustWritePEM(t, keyFile, nil, rotatedKey)
+	time.Sleep(tlsReloadInterval + 100*time.Millisecond)
+
+	resp, err = get(clientCert)
+	if err != nil {
+		t.Fatalf("Failed to get metrics after rotating the certificate, error: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.TLS.PeerCertificates[0].SerialNumber; got.Cmp(rotated.SerialNumber) != 0 {
+		t.Fatalf("Got server certificate %v after rotation, want %v", got, rotated.SerialNumber)
+	}
+}
+
+// mustCreateCertificate creates a certificate for localhost signed by parent, or a self-signed CA
+// without a parent.
+func mustCreateCertificate(t *testing.T, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate a key, error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create a certificate, error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse the certificate, error: %v", err)
+	}
+	return cert, key
+}
+
+func mustWritePEM(t *testing.T, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+
+	block := &pem.Block{}
+	if cert != nil {
+		block.Type, block.Bytes = "CERTIFICATE", cert.Raw
+	} else {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatalf("Failed to marshal the key, error: %v", err)
+		}
+		block.Type, block.Bytes = "EC PRIVATE KEY", der
+	}
+	if err := os.WriteFile(name, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Failed to write %s, error: %v", name, err)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// tracerName is the instrumentation scope of the spans of the plugin.
+	tracerName = "github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/plugin"
+
+	// Attributes of the spans of the gRPC requests, and of the Cloud KMS calls made while serving them.
+	requestUIDKey      = attribute.Key("kms.request.uid")
+	payloadSizeKey     = attribute.Key("kms.payload.size")
+	keyIDKey           = attribute.Key("kms.key_id")
+	cloudKMSVersionKey = attribute.Key("cloudkms.key_version")
+
+	// Attributes of the event of a request waiting for the identical call of another request.
+	coalescedTraceIDKey = attribute.Key("kms.coalesced.trace_id")
+	coalescedSpanIDKey  = attribute.Key("kms.coalesced.span_id")
+)
+
+// SetupTracing exports the spans of the plugin over OTLP/gRPC to endpoint, ex. localhost:4317 for a
+// collector on the node, and propagates W3C trace context so that they join the traces kube-apiserver
+// emits for KMS calls. Spans are recorded when kube-apiserver sampled its own, and for samplingRatePerMillion
+// of the requests that arrive without a trace, as configured in the TracingConfiguration of kube-apiserver.
+// The returned function flushes the spans not exported yet.
+func SetupTracing(ctx context.Context, endpoint string, samplingRatePerMillion int) (func(context.Context) error, error) {
+	// Like kube-apiserver, the collector is expected to be reachable without TLS.
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct the OTLP exporter for %s, error: %w", endpoint, err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("k8s-cloudkms-plugin")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct the tracing resource, error: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(float64(samplingRatePerMillion)/1000000))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// newTracingInterceptor starts a server span for every gRPC request, continuing the trace of kube-apiserver
+// when the request carries one. The span records the request UID, the size of the payload, the key ID
+// and the gRPC code, and is passed down to the Cloud KMS calls through the context.
+func newTracingInterceptor(tp trace.TracerProvider, propagator propagation.TextMapPropagator) grpc.UnaryServerInterceptor {
+	tracer := tp.Tracer(tracerName)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			ctx = propagator.Extract(ctx, metadataCarrier(md))
+		}
+
+		service, method, _ := strings.Cut(strings.TrimPrefix(info.FullMethod, "/"), "/")
+		ctx, span := tracer.Start(ctx, info.FullMethod,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.RPCSystemGRPC, semconv.RPCService(service), semconv.RPCMethod(method)),
+		)
+		defer span.End()
+		span.SetAttributes(requestAttributes(req)...)
+
+		resp, err := handler(ctx, req)
+
+		type keyIDer interface {
+			GetKeyId() string
+		}
+		if r, ok := resp.(keyIDer); ok && err == nil {
+			span.SetAttributes(keyIDKey.String(r.GetKeyId()))
+		} else if r, ok := req.(keyIDer); ok {
+			span.SetAttributes(keyIDKey.String(r.GetKeyId()))
+		}
+		s, _ := status.FromError(err)
+		span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(s.Code())))
+		if err != nil {
+			span.SetStatus(otelcodes.Error, s.Message())
+		}
+		return resp, err
+	}
+}
+
+// requestAttributes returns the UID and payload size of the Encrypt and Decrypt requests of KMS v1 and
+// v2, whose types are not known to this package.
+func requestAttributes(req interface{}) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if r, ok := req.(interface{ GetUid() string }); ok {
+		attrs = append(attrs, requestUIDKey.String(r.GetUid()))
+	}
+	switch r := req.(type) {
+	case interface{ GetPlaintext() []byte }:
+		attrs = append(attrs, payloadSizeKey.Int(len(r.GetPlaintext())))
+	case interface{ GetCiphertext() []byte }:
+		attrs = append(attrs, payloadSizeKey.Int(len(r.GetCiphertext())))
+	case interface{ GetPlain() []byte }:
+		attrs = append(attrs, payloadSizeKey.Int(len(r.GetPlain())))
+	case interface{ GetCipher() []byte }:
+		attrs = append(attrs, payloadSizeKey.Int(len(r.GetCipher())))
+	}
+	return attrs
+}
+
+// metadataCarrier adapts the metadata of a gRPC request to the propagators.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	kmspb "google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// encryptRequest mimics the EncryptRequest of KMS v2.
+type encryptRequest struct {
+	plaintext []byte
+	uid       string
+}
+
+func (r *encryptRequest) GetPlaintext() []byte { return r.plaintext }
+func (r *encryptRequest) GetUid() string       { return r.uid }
+
+func TestTracingInterceptor(t *testing.T) {
+	t.Parallel()
+
+	// The trace context kube-apiserver sends along with a sampled KMS call.
+	const (
+		parentTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID  = "00f067aa0ba902b7"
+		keyVersion    = "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"
+	)
+	info := &grpc.UnaryServerInfo{FullMethod: "/v2.KeyManagementService/Encrypt"}
+	req := &encryptRequest{plaintext: []byte("secret"), uid: "request-uid"}
+
+	testCases := []struct {
+		desc       string
+		err        error
+		wantStatus otelcodes.Code
+		wantCode   int64
+	}{
+		{
+			desc:       "Success",
+			wantStatus: otelcodes.Unset,
+			wantCode:   int64(codes.OK),
+		},
+		{
+			desc:       "Failure",
+			err:        status.Error(codes.Unavailable, "unavailable"),
+			wantStatus: otelcodes.Error,
+			wantCode:   int64(codes.Unavailable),
+		},
+	}
+
+	for _, testCase := range testCases {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		interceptor := newTracingInterceptor(tp, propagation.TraceContext{})
+
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", "00-"+parentTraceID+"-"+parentSpanID+"-01"))
+		_, err := interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			// The Cloud KMS call names the key version on the span of the request.
+			if _, err := Call(ctx, "encrypt", Backoff{}, nil, func(...googleapi.CallOption) (*kmspb.EncryptResponse, error) {
+				return &kmspb.EncryptResponse{Name: keyVersion}, nil
+			}); err != nil {
+				t.Fatalf("%s: failed to call Cloud KMS, error: %v", testCase.desc, err)
+			}
+			return nil, testCase.err
+		})
+		if status.Code(err) != status.Code(testCase.err) {
+			t.Fatalf("%s: got error %v, want %v", testCase.desc, err, testCase.err)
+		}
+
+		spans := recorder.Ended()
+		if len(spans) != 1 {
+			t.Fatalf("%s: got %d spans, want 1", testCase.desc, len(spans))
+		}
+		span := spans[0]
+		if got := span.Parent().TraceID().String(); got != parentTraceID || span.SpanContext().TraceID().String() != parentTraceID {
+			t.Fatalf("%s: got parent trace %s, want %s", testCase.desc, got, parentTraceID)
+		}
+		if got := span.Parent().SpanID().String(); got != parentSpanID {
+			t.Fatalf("%s: got parent span %s, want %s", testCase.desc, got, parentSpanID)
+		}
+		if span.SpanKind() != trace.SpanKindServer {
+			t.Fatalf("%s: got span kind %v, want %v", testCase.desc, span.SpanKind(), trace.SpanKindServer)
+		}
+		if got := span.Status().Code; got != testCase.wantStatus {
+			t.Fatalf("%s: got span status %v, want %v", testCase.desc, got, testCase.wantStatus)
+		}
+
+		attrs := attribute.NewSet(span.Attributes()...)
+		for _, want := range []attribute.KeyValue{
+			requestUIDKey.String("request-uid"),
+			payloadSizeKey.Int(len("secret")),
+			cloudKMSVersionKey.String(keyVersion),
+			attribute.Int64("rpc.grpc.status_code", testCase.wantCode),
+			attribute.String("rpc.method", "Encrypt"),
+		} {
+			if got, ok := attrs.Value(want.Key); !ok || got != want.Value {
+				t.Fatalf("%s: got attribute %s=%v, want %v", testCase.desc, want.Key, got.Emit(), want.Value.Emit())
+			}
+		}
+	}
+}
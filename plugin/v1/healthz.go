@@ -15,7 +15,9 @@
 package v1
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/plugin"
@@ -44,23 +46,29 @@ func (h *HealthChecker) PingRPC(ctx context.Context, conn *grpc.ClientConn) erro
 	return nil
 }
 
+// PingKMS encrypts a payload and checks that it decrypts back to the same bytes.
 func (h *HealthChecker) PingKMS(ctx context.Context, conn *grpc.ClientConn) error {
 	client := NewKeyManagementServiceClient(conn)
 
+	plain := []byte("secret")
 	encryptResponse, err := client.Encrypt(ctx, &EncryptRequest{
 		Version: apiVersion,
-		Plain:   []byte("secret"),
+		Plain:   plain,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to ping KMS: %w", err)
 	}
 
-	if _, err = client.Decrypt(ctx, &DecryptRequest{
+	decryptResponse, err := client.Decrypt(ctx, &DecryptRequest{
 		Version: apiVersion,
-		Cipher:  []byte(encryptResponse.Cipher),
-	}); err != nil {
+		Cipher:  encryptResponse.Cipher,
+	})
+	if err != nil {
 		return fmt.Errorf("failed to ping KMS: %w", err)
 	}
+	if !bytes.Equal(decryptResponse.Plain, plain) {
+		return errors.New("failed to ping KMS: payload decrypted to different bytes")
+	}
 
 	return nil
 }
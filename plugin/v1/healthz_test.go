@@ -15,6 +15,8 @@
 package v1
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -49,6 +51,14 @@ func TestHealthzServer(t *testing.T) {
 				HTTPStatusCode: http.StatusOK,
 			},
 		}
+		// The ping decrypts back to the payload it encrypted.
+		pingDecryptResponse = &cloudkms.DecryptResponse{
+			Plaintext:       base64.StdEncoding.EncodeToString([]byte("secret")),
+			PlaintextCrc32c: plugin.CRC32C([]byte("secret")),
+			ServerResponse: googleapi.ServerResponse{
+				HTTPStatusCode: http.StatusOK,
+			},
+		}
 	)
 
 	testCases := []struct {
@@ -70,9 +80,15 @@ func TestHealthzServer(t *testing.T) {
 		{
 			desc:     "Positive response for TestIAM, Positive ping from CloudKMS",
 			query:    "ping-kms=true",
-			response: []json.Marshaler{positiveTestIAMResponse, positiveEncryptResponse, positiveDecryptResponse},
+			response: []json.Marshaler{positiveTestIAMResponse, positiveEncryptResponse, pingDecryptResponse},
 			want:     http.StatusOK,
 		},
+		{
+			desc:     "Positive response for TestIAM, ping from CloudKMS decrypts to different bytes",
+			query:    "ping-kms=true",
+			response: []json.Marshaler{positiveTestIAMResponse, positiveEncryptResponse, positiveDecryptResponse},
+			want:     http.StatusServiceUnavailable,
+		},
 		{
 			desc:     "Positive response for TestIAM, Negative ping from CloudKMS",
 			query:    "ping-kms=true",
@@ -93,7 +109,7 @@ func TestHealthzServer(t *testing.T) {
 			// Ensure that serving both Metrics and Healthz
 			mustServeMetrics(t)
 
-			healthzPort := mustServeHealthz(t, tt)
+			healthzPort, _ := mustServeHealthz(t, tt)
 
 			u := url.URL{
 				Scheme:   "http",
@@ -109,6 +125,35 @@ func TestHealthzServer(t *testing.T) {
 	}
 }
 
+func TestHealthzShutdown(t *testing.T) {
+	t.Parallel()
+
+	tt := setUpWithResponses(t, keyName, 0)
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	healthzPort, healthCheckerManager := mustServeHealthz(t, tt)
+	u := url.URL{
+		Scheme: "http",
+		Host:   fmt.Sprintf("localhost:%d", healthzPort),
+		Path:   "healthz",
+	}
+
+	healthCheckerManager.SetShuttingDown()
+	if gotStatus, gotBody := mustGetHealthz(t, u); gotStatus != http.StatusServiceUnavailable {
+		t.Fatalf("Got %d for healthz status while shutting down, want %d, response: %q", gotStatus, http.StatusServiceUnavailable, gotBody)
+	}
+
+	if err := healthCheckerManager.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down healthz server, error: %v", err)
+	}
+	if resp, err := http.Get(u.String()); err == nil {
+		resp.Body.Close()
+		t.Fatal("Expected healthz server to be shut down")
+	}
+}
+
 func mustGetHealthz(t *testing.T, url url.URL) (int, []byte) {
 	t.Helper()
 	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
@@ -128,7 +173,7 @@ func mustGetHealthz(t *testing.T, url url.URL) (int, []byte) {
 	return resp.StatusCode, b
 }
 
-func mustServeHealthz(t *testing.T, tt *pluginTestCase) int {
+func mustServeHealthz(t *testing.T, tt *pluginTestCase) (int, *plugin.HealthCheckerManager) {
 	t.Helper()
 
 	p, err := freeport.GetFreePort()
@@ -153,5 +198,5 @@ func mustServeHealthz(t *testing.T, tt *pluginTestCase) int {
 	case <-time.After(3 * time.Second):
 	}
 
-	return p
+	return p, healthCheckerManager
 }
@@ -17,6 +17,7 @@ package v1
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"time"
@@ -41,14 +42,73 @@ var _ plugin.Plugin = (*Plugin)(nil)
 type Plugin struct {
 	keyService *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService
 	keyURI     string
+	// aad is sent as additional authenticated data with every encrypt and decrypt call.
+	aad []byte
+	// decryptWithoutAAD makes Decrypt retry without aad, for payloads encrypted before it was configured.
+	decryptWithoutAAD bool
+	// decryptKeyURIs are historical keys to fall back to when keyURI cannot decrypt the ciphertext.
+	decryptKeyURIs []string
+	// backoff configures retries of Cloud KMS calls.
+	backoff plugin.Backoff
+	// breaker fails Cloud KMS calls fast while Cloud KMS is unavailable.
+	breaker *plugin.CircuitBreaker
+	// decrypts coalesces concurrent Decrypt requests for the same ciphertext into one.
+	decrypts plugin.Flight
+}
+
+// Option configures optional behaviour of Plugin.
+type Option func(*Plugin)
+
+// WithDecryptKeyURIs configures keys that Decrypt falls back to, in order, when keyURI cannot decrypt
+// the ciphertext.
+func WithDecryptKeyURIs(keyURIs ...string) Option {
+	return func(p *Plugin) {
+		p.decryptKeyURIs = keyURIs
+	}
+}
+
+// WithBackoff makes Cloud KMS calls that fail with a retryable error be retried according to b.
+func WithBackoff(b plugin.Backoff) Option {
+	return func(p *Plugin) {
+		p.backoff = b
+	}
+}
+
+// WithCircuitBreaker makes Cloud KMS calls fail fast while cb is open.
+func WithCircuitBreaker(cb *plugin.CircuitBreaker) Option {
+	return func(p *Plugin) {
+		p.breaker = cb
+	}
+}
+
+// WithAdditionalAuthenticatedData binds ciphertexts to aad (ex. a cluster UID).
+// Note that payloads encrypted without aad cannot be decrypted once it is configured,
+// unless the plugin is also constructed WithDecryptWithoutAAD.
+func WithAdditionalAuthenticatedData(aad []byte) Option {
+	return func(p *Plugin) {
+		p.aad = aad
+	}
+}
+
+// WithDecryptWithoutAAD makes Decrypt retry each key without the additional authenticated data when
+// decryption with it fails, so that payloads encrypted before it was configured remain readable
+// until they are re-encrypted.
+func WithDecryptWithoutAAD() Option {
+	return func(p *Plugin) {
+		p.decryptWithoutAAD = true
+	}
 }
 
 // NewPlugin creates a new v1 plugin
-func NewPlugin(keyService *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService, keyURI string) *Plugin {
-	return &Plugin{
+func NewPlugin(keyService *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService, keyURI string, opts ...Option) *Plugin {
+	p := &Plugin{
 		keyService: keyService,
 		keyURI:     keyURI,
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
 // Register registers the plugin as a service management service.
@@ -70,12 +130,10 @@ func (g *Plugin) Encrypt(ctx context.Context, request *EncryptRequest) (*Encrypt
 	glog.V(4).Infoln("Processing request for encryption.")
 	defer plugin.RecordCloudKMSOperation("encrypt", time.Now().UTC())
 
-	resp, err := g.keyService.Encrypt(g.keyURI, &cloudkms.EncryptRequest{
-		Plaintext: base64.StdEncoding.EncodeToString(request.Plain),
-	}).Context(ctx).Do()
+	resp, err := plugin.Call(ctx, "encrypt", g.backoff, g.breaker, g.keyService.Encrypt(g.keyURI, plugin.NewEncryptRequest(request.Plain, g.aad)).Context(ctx).Do)
 	if err != nil {
 		plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("encrypt").Inc()
-		return nil, err
+		return nil, plugin.ConvertChecksumRejection("encrypt", err)
 	}
 
 	cipher, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
@@ -83,6 +141,10 @@ func (g *Plugin) Encrypt(ctx context.Context, request *EncryptRequest) (*Encrypt
 		return nil, err
 	}
 
+	if err := plugin.VerifyEncryptResponse(resp, cipher, g.aad); err != nil {
+		return nil, err
+	}
+
 	return &EncryptResponse{
 		Cipher: cipher,
 	}, nil
@@ -91,22 +153,84 @@ func (g *Plugin) Encrypt(ctx context.Context, request *EncryptRequest) (*Encrypt
 // Decrypt decrypts payload supplied by K8S API Server.
 func (g *Plugin) Decrypt(ctx context.Context, request *DecryptRequest) (*DecryptResponse, error) {
 	glog.V(4).Infoln("Processing request for decryption.")
-	defer plugin.RecordCloudKMSOperation("decrypt", time.Now().UTC())
 
-	resp, err := g.keyService.Decrypt(g.keyURI, &cloudkms.DecryptRequest{
-		Ciphertext: base64.StdEncoding.EncodeToString(request.Cipher),
-	}).Context(ctx).Do()
+	key := sha256.Sum256(request.Cipher)
+	plain, err := g.decrypts.Do(ctx, "decrypt", string(key[:]), func(ctx context.Context) ([]byte, error) {
+		return g.decrypt(ctx, request.Cipher)
+	})
 	if err != nil {
-		plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("decrypt").Inc()
 		return nil, err
 	}
 
-	plain, err := base64.StdEncoding.DecodeString(resp.Plaintext)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode from base64, error: %w", err)
-	}
-
 	return &DecryptResponse{
 		Plain: plain,
 	}, nil
 }
+
+func (g *Plugin) decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	defer plugin.RecordCloudKMSOperation("decrypt", time.Now().UTC())
+
+	aads := [][]byte{g.aad}
+	if g.decryptWithoutAAD && len(g.aad) != 0 {
+		aads = append(aads, nil)
+	}
+
+	var firstErr error
+	for _, keyURI := range append([]string{g.keyURI}, g.decryptKeyURIs...) {
+		resp, err := g.decryptWithKey(ctx, keyURI, ciphertext, aads)
+		if err != nil {
+			// A corrupted request must not be retried with other keys.
+			if plugin.IsIntegrityError(err) {
+				plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("decrypt").Inc()
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			// Another key cannot help while Cloud KMS is unavailable, it would only multiply the calls.
+			if !plugin.IsKeyError(err) {
+				break
+			}
+			continue
+		}
+
+		plain, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode from base64, error: %w", err)
+		}
+
+		if err := plugin.VerifyDecryptResponse(resp, plain); err != nil {
+			return nil, err
+		}
+
+		return plain, nil
+	}
+
+	plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("decrypt").Inc()
+	return nil, firstErr
+}
+
+// decryptWithKey decrypts ciphertext using keyURI with each of aads in turn.
+func (g *Plugin) decryptWithKey(ctx context.Context, keyURI string, ciphertext []byte, aads [][]byte) (*cloudkms.DecryptResponse, error) {
+	var firstErr error
+	for _, aad := range aads {
+		resp, err := plugin.Call(ctx, "decrypt", g.backoff, g.breaker, g.keyService.Decrypt(keyURI, plugin.NewDecryptRequest(ciphertext, aad)).Context(ctx).Do)
+		if err = plugin.ConvertChecksumRejection("decrypt", err); plugin.IsIntegrityError(err) {
+			return nil, err
+		}
+		if err == nil {
+			if len(aad) == 0 && len(g.aad) != 0 {
+				glog.V(4).Infof("Decrypted using %s without additional authenticated data", keyURI)
+			}
+			return resp, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		glog.V(4).Infof("Failed to decrypt using %s, error: %v", keyURI, err)
+		if !plugin.IsKeyError(err) {
+			break
+		}
+	}
+	return nil, firstErr
+}
@@ -17,6 +17,7 @@ package v1
 import (
 	"bufio"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -25,6 +26,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -52,15 +54,21 @@ const (
 )
 
 var (
+	plaintextCRC32C  = plugin.CRC32C([]byte("foo"))
+	ciphertextCRC32C = plugin.CRC32C([]byte("bar"))
+
 	positiveEncryptResponse = &cloudkms.EncryptResponse{
-		Ciphertext: ciphertext,
-		Name:       keyName,
+		Ciphertext:              ciphertext,
+		CiphertextCrc32c:        ciphertextCRC32C,
+		VerifiedPlaintextCrc32c: true,
+		Name:                    keyName,
 		ServerResponse: googleapi.ServerResponse{
 			HTTPStatusCode: http.StatusOK,
 		},
 	}
 	positiveDecryptResponse = &cloudkms.DecryptResponse{
-		Plaintext: plaintext,
+		Plaintext:       plaintext,
+		PlaintextCrc32c: plaintextCRC32C,
 		ServerResponse: googleapi.ServerResponse{
 			HTTPStatusCode: http.StatusOK,
 		},
@@ -136,6 +144,7 @@ func setUpWithResponses(t *testing.T, keyName string, delay time.Duration, respo
 }
 
 func TestMain(m *testing.M) {
+	plugin.RegisterLegacyMetrics()
 	os.Exit(m.Run())
 }
 
@@ -151,7 +160,7 @@ func TestEncrypt(t *testing.T) {
 	}{
 		{
 			desc:                "Encrypt",
-			wantEncryptRequests: []*cloudkms.EncryptRequest{{Plaintext: plaintext}},
+			wantEncryptRequests: []*cloudkms.EncryptRequest{{Plaintext: plaintext, PlaintextCrc32c: plaintextCRC32C}},
 			testFn: func(t *testing.T, p *Plugin) {
 				encryptRequest := EncryptRequest{Version: apiVersion, Plain: []byte("foo")}
 				if _, err := p.Encrypt(context.Background(), &encryptRequest); err != nil {
@@ -162,7 +171,7 @@ func TestEncrypt(t *testing.T) {
 		},
 		{
 			desc:                "Decrypt",
-			wantDecryptRequests: []*cloudkms.DecryptRequest{{Ciphertext: ciphertext}},
+			wantDecryptRequests: []*cloudkms.DecryptRequest{{Ciphertext: ciphertext, CiphertextCrc32c: ciphertextCRC32C}},
 			testFn: func(t *testing.T, p *Plugin) {
 				decryptRequest := DecryptRequest{Version: apiVersion, Cipher: []byte("bar")}
 				if _, err := p.Decrypt(context.Background(), &decryptRequest); err != nil {
@@ -196,6 +205,142 @@ func TestEncrypt(t *testing.T) {
 	}
 }
 
+func TestDecryptFallback(t *testing.T) {
+	t.Parallel()
+
+	tt := setUpWithResponses(t, keyName, 0, positiveDecryptResponse)
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	// FakeKMS does not serve newKey, so decryption has to fall back to keyName.
+	p := NewPlugin(tt.plugin.keyService, "newKey", WithDecryptKeyURIs(keyName))
+	resp, err := p.Decrypt(context.Background(), &DecryptRequest{Version: apiVersion, Cipher: []byte("bar")})
+	if err != nil {
+		t.Fatalf("Failed to decrypt with the fallback key, error: %v", err)
+	}
+	if string(resp.Plain) != "foo" {
+		t.Fatalf("Got %q after decryption, want %q", resp.Plain, "foo")
+	}
+	if err := tt.fakeKMSSrv.DecryptRequestsEqual([]*cloudkms.DecryptRequest{{Ciphertext: ciphertext, CiphertextCrc32c: ciphertextCRC32C}}); err != nil {
+		t.Fatalf("Failed to compare last processed request on KMS Server, error: %v", err)
+	}
+}
+
+func TestCoalescedDecrypt(t *testing.T) {
+	t.Parallel()
+
+	// FakeKMS serves a single response, the plugin must not call it again for identical requests.
+	tt := setUpWithResponses(t, keyName, 500*time.Millisecond, positiveDecryptResponse)
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := tt.plugin.Decrypt(context.Background(), &DecryptRequest{Version: apiVersion, Cipher: []byte("bar")})
+			if err == nil && string(resp.Plain) != "foo" {
+				err = fmt.Errorf("got %q after decryption, want %q", resp.Plain, "foo")
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Failed to decrypt, error: %v", err)
+		}
+	}
+	if got := tt.fakeKMSSrv.DecryptRequestsCount(); got != 1 {
+		t.Fatalf("Got %d decrypt requests to Cloud KMS, want 1", got)
+	}
+}
+
+func TestAdditionalAuthenticatedData(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	aadEncryptResponse := *positiveEncryptResponse
+	aadEncryptResponse.VerifiedAdditionalAuthenticatedDataCrc32c = true
+	tt := setUpWithResponses(t, keyName, 0, &aadEncryptResponse, positiveDecryptResponse)
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	aad := []byte("cluster-uid")
+	p := NewPlugin(tt.plugin.keyService, keyName, WithAdditionalAuthenticatedData(aad))
+	if _, err := p.Encrypt(ctx, &EncryptRequest{Version: apiVersion, Plain: []byte("foo")}); err != nil {
+		t.Fatalf("Failed to encrypt, error: %v", err)
+	}
+	if _, err := p.Decrypt(ctx, &DecryptRequest{Version: apiVersion, Cipher: []byte("bar")}); err != nil {
+		t.Fatalf("Failed to decrypt, error: %v", err)
+	}
+
+	if err := tt.fakeKMSSrv.EncryptRequestsEqual([]*cloudkms.EncryptRequest{{
+		Plaintext:                         plaintext,
+		PlaintextCrc32c:                   plaintextCRC32C,
+		AdditionalAuthenticatedData:       base64.StdEncoding.EncodeToString(aad),
+		AdditionalAuthenticatedDataCrc32c: plugin.CRC32C(aad),
+	}}); err != nil {
+		t.Fatalf("Failed to compare last processed request on KMS Server, error: %v", err)
+	}
+	if err := tt.fakeKMSSrv.DecryptRequestsEqual([]*cloudkms.DecryptRequest{{
+		Ciphertext:                        ciphertext,
+		CiphertextCrc32c:                  ciphertextCRC32C,
+		AdditionalAuthenticatedData:       base64.StdEncoding.EncodeToString(aad),
+		AdditionalAuthenticatedDataCrc32c: plugin.CRC32C(aad),
+	}}); err != nil {
+		t.Fatalf("Failed to compare last processed request on KMS Server, error: %v", err)
+	}
+}
+
+func TestDecryptWithoutAdditionalAuthenticatedData(t *testing.T) {
+	t.Parallel()
+
+	// The payload was encrypted before the AAD was configured, so decryption with the AAD fails.
+	tt := setUpWithResponses(t, keyName, 0,
+		&cloudkms.DecryptResponse{
+			ServerResponse: googleapi.ServerResponse{
+				HTTPStatusCode: http.StatusBadRequest,
+			},
+		},
+		positiveDecryptResponse)
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	aad := []byte("cluster-uid")
+	p := NewPlugin(tt.plugin.keyService, keyName, WithAdditionalAuthenticatedData(aad), WithDecryptWithoutAAD())
+	resp, err := p.Decrypt(context.Background(), &DecryptRequest{Version: apiVersion, Cipher: []byte("bar")})
+	if err != nil {
+		t.Fatalf("Failed to decrypt without AAD, error: %v", err)
+	}
+	if string(resp.Plain) != "foo" {
+		t.Fatalf("Got %q after decryption, want %q", resp.Plain, "foo")
+	}
+
+	if err := tt.fakeKMSSrv.DecryptRequestsEqual([]*cloudkms.DecryptRequest{
+		{
+			Ciphertext:                        ciphertext,
+			CiphertextCrc32c:                  ciphertextCRC32C,
+			AdditionalAuthenticatedData:       base64.StdEncoding.EncodeToString(aad),
+			AdditionalAuthenticatedDataCrc32c: plugin.CRC32C(aad),
+		},
+		{
+			Ciphertext:       ciphertext,
+			CiphertextCrc32c: ciphertextCRC32C,
+		},
+	}); err != nil {
+		t.Fatalf("Failed to compare processed requests on KMS Server, error: %v", err)
+	}
+}
+
 func TestGatherMetrics(t *testing.T) {
 	t.Parallel()
 
@@ -215,6 +360,7 @@ func TestGatherMetrics(t *testing.T) {
 				}
 			},
 			want: []string{
+				"cloudkms_plugin_cloudkms_request_duration_seconds",
 				"roundtrip_latencies",
 			},
 			response: positiveDecryptResponse,
@@ -229,6 +375,7 @@ func TestGatherMetrics(t *testing.T) {
 				}
 			},
 			want: []string{
+				"cloudkms_plugin_cloudkms_request_duration_seconds",
 				"roundtrip_latencies",
 				"failures_count",
 			},
@@ -248,6 +395,7 @@ func TestGatherMetrics(t *testing.T) {
 				}
 			},
 			want: []string{
+				"cloudkms_plugin_cloudkms_request_duration_seconds",
 				"roundtrip_latencies",
 			},
 			response: positiveEncryptResponse,
@@ -262,6 +410,7 @@ func TestGatherMetrics(t *testing.T) {
 				}
 			},
 			want: []string{
+				"cloudkms_plugin_cloudkms_request_duration_seconds",
 				"roundtrip_latencies",
 				"failures_count",
 			},
@@ -362,7 +511,7 @@ func TestMetricsServer(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to scrape metrics, %v", err)
 	}
-	checkForExpectedMetrics(t, m, []string{"roundtrip_latencies"})
+	checkForExpectedMetrics(t, m, []string{"cloudkms_plugin_cloudkms_request_duration_seconds", "roundtrip_latencies"})
 }
 
 func mustServeMetrics(t *testing.T) int {
@@ -0,0 +1,284 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/golang/glog"
+	"google.golang.org/api/cloudkms/v1"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/plugin"
+)
+
+// Regex to extract Cloud KMS key version resource name from the key ID
+var keyVersionResourceRegEx = regexp.MustCompile(`projects\/[^/]+\/locations\/[^/]+\/keyRings\/[^/]+\/cryptoKeys\/[^/]+\/cryptoKeyVersions\/[^/:]+`)
+
+// oaepHashes maps asymmetric decryption algorithms of Cloud KMS to the digest used for OAEP padding.
+var oaepHashes = map[string]crypto.Hash{
+	"RSA_DECRYPT_OAEP_2048_SHA256": crypto.SHA256,
+	"RSA_DECRYPT_OAEP_3072_SHA256": crypto.SHA256,
+	"RSA_DECRYPT_OAEP_4096_SHA256": crypto.SHA256,
+	"RSA_DECRYPT_OAEP_4096_SHA512": crypto.SHA512,
+	"RSA_DECRYPT_OAEP_2048_SHA1":   crypto.SHA1,
+	"RSA_DECRYPT_OAEP_3072_SHA1":   crypto.SHA1,
+	"RSA_DECRYPT_OAEP_4096_SHA1":   crypto.SHA1,
+}
+
+var _ plugin.Plugin = (*AsymmetricPlugin)(nil)
+
+// AsymmetricPlugin uses a Cloud KMS asymmetric decryption key version. Payloads are encrypted locally
+// with the public key of the version, so that only Decrypt depends on Cloud KMS being reachable.
+type AsymmetricPlugin struct {
+	keyService *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService
+	keyVersion string
+	keySuffix  string
+	// backoff configures retries of Cloud KMS calls.
+	backoff plugin.Backoff
+	// breaker fails Cloud KMS calls fast while Cloud KMS is unavailable.
+	breaker *plugin.CircuitBreaker
+
+	// publicKey is fetched from Cloud KMS on first use and again by every Status, which drops it
+	// once the key version is disabled or destroyed.
+	publicKey     *rsa.PublicKey
+	oaepHash      crypto.Hash
+	publicKeyLock sync.Mutex
+
+	// decrypts coalesces concurrent identical Decrypt requests into one.
+	decrypts plugin.Flight
+}
+
+// AsymmetricOption configures optional behaviour of AsymmetricPlugin.
+type AsymmetricOption func(*AsymmetricPlugin)
+
+// WithAsymmetricBackoff makes Cloud KMS calls that fail with a retryable error be retried according to b.
+func WithAsymmetricBackoff(b plugin.Backoff) AsymmetricOption {
+	return func(p *AsymmetricPlugin) {
+		p.backoff = b
+	}
+}
+
+// WithAsymmetricCircuitBreaker makes Cloud KMS calls fail fast while cb is open.
+func WithAsymmetricCircuitBreaker(cb *plugin.CircuitBreaker) AsymmetricOption {
+	return func(p *AsymmetricPlugin) {
+		p.breaker = cb
+	}
+}
+
+// NewAsymmetricPlugin constructs AsymmetricPlugin for the key version resource name keyVersion.
+func NewAsymmetricPlugin(keyService *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService, keyVersion, keySuffix string, opts ...AsymmetricOption) *AsymmetricPlugin {
+	p := &AsymmetricPlugin{
+		keyService: keyService,
+		keyVersion: keyVersion,
+		keySuffix:  keySuffix,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Register registers the plugin as a service management service.
+func (g *AsymmetricPlugin) Register(s *grpc.Server) {
+	RegisterKeyManagementServiceServer(s, g)
+}
+
+// Status returns the version of KMS API version that plugin supports and the configured key version.
+// The plugin is healthy while Cloud KMS serves the public key of the key version, which it refuses to
+// do once the version is disabled or destroyed.
+func (g *AsymmetricPlugin) Status(ctx context.Context, request *StatusRequest) (*StatusResponse, error) {
+	statusResp := &StatusResponse{
+		Version: apiVersion,
+		KeyId:   g.keyID(),
+		Healthz: ok,
+	}
+
+	g.publicKeyLock.Lock()
+	_, _, err := g.fetchPublicKey(ctx)
+	switch {
+	case plugin.IsCircuitOpen(err):
+		statusResp.Healthz = circuitOpen
+	case isKeyVersionUnusable(err):
+		// Stop encrypting with a public key whose private key can no longer decrypt.
+		glog.Warningf("Key version %s is not usable, error: %v", g.keyVersion, err)
+		g.publicKey = nil
+		statusResp.Healthz = keyDisabled
+	case err != nil:
+		glog.Warningf("Failed to get the public key of %s, error: %v", g.keyVersion, err)
+		statusResp.Healthz = keyNotReachable
+	}
+	g.publicKeyLock.Unlock()
+
+	glog.V(4).Infof("Status response: %s", statusResp.Healthz)
+	return statusResp, nil
+}
+
+// Encrypt encrypts payload provided by K8S API Server with the public key of the key version.
+func (g *AsymmetricPlugin) Encrypt(ctx context.Context, request *EncryptRequest) (*EncryptResponse, error) {
+	glog.V(4).Infof("Processing request for encryption %s using %s", request.Uid, g.keyVersion)
+
+	publicKey, oaepHash, err := g.loadPublicKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// RSA-OAEP can only encrypt payloads of up to the key size less twice the digest size and two bytes.
+	if limit := publicKey.Size() - 2*oaepHash.Size() - 2; len(request.Plaintext) > limit {
+		return nil, fmt.Errorf("payload of %d bytes exceeds the maximum of %d bytes the public key of %s can encrypt", len(request.Plaintext), limit, g.keyVersion)
+	}
+
+	cipher, err := rsa.EncryptOAEP(oaepHash.New(), rand.Reader, publicKey, request.Plaintext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt with the public key of %s, error: %w", g.keyVersion, err)
+	}
+
+	return &EncryptResponse{
+		Ciphertext: cipher,
+		KeyId:      g.keyID(),
+	}, nil
+}
+
+// Decrypt decrypts payload supplied by K8S API Server with Cloud KMS.
+func (g *AsymmetricPlugin) Decrypt(ctx context.Context, request *DecryptRequest) (*DecryptResponse, error) {
+	glog.V(4).Infof("Processing request for decryption %s using %s", request.Uid, request.KeyId)
+	defer plugin.RecordCloudKMSOperation("decrypt", time.Now().UTC())
+
+	keyVersion := g.keyVersion
+	if request.KeyId != "" { // request.KeyId is empty when health checker calls this method from PingKMS()
+		keyVersion = keyVersionResourceRegEx.FindString(request.KeyId)
+	}
+
+	plain, err := g.decrypts.Do(ctx, "decrypt", decryptFlightKey(request), func(ctx context.Context) ([]byte, error) {
+		return g.decrypt(ctx, keyVersion, request.Ciphertext)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DecryptResponse{
+		Plaintext: plain,
+	}, nil
+}
+
+func (g *AsymmetricPlugin) decrypt(ctx context.Context, keyVersion string, ciphertext []byte) ([]byte, error) {
+	resp, err := plugin.Call(ctx, "decrypt", g.backoff, g.breaker, g.keyService.CryptoKeyVersions.AsymmetricDecrypt(keyVersion, &cloudkms.AsymmetricDecryptRequest{
+		Ciphertext:       base64.StdEncoding.EncodeToString(ciphertext),
+		CiphertextCrc32c: plugin.CRC32C(ciphertext),
+		ForceSendFields:  []string{"CiphertextCrc32c"},
+	}).Context(ctx).Do)
+	if err != nil {
+		plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("decrypt").Inc()
+		return nil, plugin.ConvertChecksumRejection("decrypt", err)
+	}
+
+	plain, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode from base64, error: %w", err)
+	}
+
+	if !resp.VerifiedCiphertextCrc32c {
+		return nil, plugin.NewIntegrityError("decrypt", "Cloud KMS did not verify the checksum of the ciphertext")
+	}
+	if resp.PlaintextCrc32c != plugin.CRC32C(plain) {
+		return nil, plugin.NewIntegrityError("decrypt", "checksum of the plaintext returned by Cloud KMS does not match")
+	}
+	return plain, nil
+}
+
+// loadPublicKey returns the public key of the key version, fetching it from Cloud KMS on first use.
+func (g *AsymmetricPlugin) loadPublicKey(ctx context.Context) (*rsa.PublicKey, crypto.Hash, error) {
+	g.publicKeyLock.Lock()
+	defer g.publicKeyLock.Unlock()
+
+	if g.publicKey != nil {
+		return g.publicKey, g.oaepHash, nil
+	}
+	return g.fetchPublicKey(ctx)
+}
+
+// fetchPublicKey fetches the public key of the key version from Cloud KMS and caches it.
+// publicKeyLock must be held.
+func (g *AsymmetricPlugin) fetchPublicKey(ctx context.Context) (*rsa.PublicKey, crypto.Hash, error) {
+	start := time.Now().UTC()
+	resp, err := plugin.Call(ctx, "get_public_key", g.backoff, g.breaker, g.keyService.CryptoKeyVersions.GetPublicKey(g.keyVersion).Context(ctx).Do)
+	plugin.RecordCloudKMSOperation("get_public_key", start)
+	if err != nil {
+		plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("get_public_key").Inc()
+		return nil, 0, err
+	}
+	if resp.PemCrc32c != plugin.CRC32C([]byte(resp.Pem)) {
+		return nil, 0, plugin.NewIntegrityError("get_public_key", "checksum of the public key returned by Cloud KMS does not match")
+	}
+
+	oaepHash, ok := oaepHashes[resp.Algorithm]
+	if !ok {
+		return nil, 0, fmt.Errorf("key version %s has algorithm %s, want one of RSA_DECRYPT_OAEP_*", g.keyVersion, resp.Algorithm)
+	}
+
+	block, _ := pem.Decode([]byte(resp.Pem))
+	if block == nil {
+		return nil, 0, fmt.Errorf("failed to decode PEM public key of %s", g.keyVersion)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse public key of %s, error: %w", g.keyVersion, err)
+	}
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, 0, fmt.Errorf("public key of %s is %T, want an RSA key", g.keyVersion, key)
+	}
+
+	if g.publicKey == nil {
+		glog.Infof("Fetched %s public key of %s", resp.Algorithm, g.keyVersion)
+	}
+	g.publicKey, g.oaepHash = publicKey, oaepHash
+	return publicKey, oaepHash, nil
+}
+
+// isKeyVersionUnusable reports whether err is Cloud KMS refusing to serve a key version that is not
+// enabled, was destroyed or that the plugin is no longer permitted to use.
+func isKeyVersionUnusable(err error) bool {
+	switch status.Code(plugin.StatusError(err)) {
+	case codes.FailedPrecondition, codes.NotFound, codes.PermissionDenied:
+		return true
+	default:
+		return false
+	}
+}
+
+// keyID returns the key version with the key suffix appended, if any.
+func (g *AsymmetricPlugin) keyID() string {
+	if g.keySuffix != "" {
+		return g.keyVersion + ":" + g.keySuffix
+	}
+	return g.keyVersion
+}
@@ -0,0 +1,321 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/plugin"
+	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/testutils/fakekms"
+)
+
+// setUpAsymmetric constructs AsymmetricPlugin served by FakeKMS with the public key of privateKey,
+// followed by responses.
+func setUpAsymmetric(t *testing.T, privateKey *rsa.PrivateKey, algorithm string, pemCRC32CDelta int64, responses ...json.Marshaler) *AsymmetricPlugin {
+	t.Helper()
+
+	return setUpAsymmetricWithDelay(t, privateKey, algorithm, pemCRC32CDelta, 0, responses...)
+}
+
+// setUpAsymmetricWithDelay is setUpAsymmetric with FakeKMS answering every request after delay.
+func setUpAsymmetricWithDelay(t *testing.T, privateKey *rsa.PrivateKey, algorithm string, pemCRC32CDelta int64, delay time.Duration, responses ...json.Marshaler) *AsymmetricPlugin {
+	t.Helper()
+
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyVersionName, 0, delay, append([]json.Marshaler{
+		publicKeyResponse(t, privateKey, algorithm, pemCRC32CDelta),
+	}, responses...)...)
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	t.Cleanup(fakeKMSSrv.Close)
+
+	kms, err := cloudkms.NewService(context.Background(), option.WithHTTPClient(fakeKMSSrv.Client()))
+	if err != nil {
+		t.Fatalf("failed to instantiate cloud kms httpClient: %v", err)
+	}
+	kms.BasePath = fakeKMSSrv.URL()
+	return NewAsymmetricPlugin(kms.Projects.Locations.KeyRings.CryptoKeys, keyVersionName, keySuffix)
+}
+
+// publicKeyResponse is the public key of privateKey as served by Cloud KMS, with pemCRC32CDelta added
+// to its checksum.
+func publicKeyResponse(t *testing.T, privateKey *rsa.PrivateKey, algorithm string, pemCRC32CDelta int64) *cloudkms.PublicKey {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal RSA public key, error: %v", err)
+	}
+	publicKeyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return &cloudkms.PublicKey{
+		Name:      keyVersionName,
+		Algorithm: algorithm,
+		Pem:       publicKeyPEM,
+		PemCrc32c: plugin.CRC32C([]byte(publicKeyPEM)) + pemCRC32CDelta,
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: http.StatusOK,
+		},
+	}
+}
+
+func TestAsymmetricPlugin(t *testing.T) {
+	t.Parallel()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key, error: %v", err)
+	}
+	p := setUpAsymmetric(t, privateKey, "RSA_DECRYPT_OAEP_2048_SHA256", 0,
+		&cloudkms.AsymmetricDecryptResponse{
+			Plaintext:                plaintext,
+			PlaintextCrc32c:          plaintextCRC32C,
+			VerifiedCiphertextCrc32c: true,
+			ServerResponse: googleapi.ServerResponse{
+				HTTPStatusCode: http.StatusOK,
+			},
+		},
+		&cloudkms.AsymmetricDecryptResponse{
+			Plaintext:       plaintext,
+			PlaintextCrc32c: plaintextCRC32C,
+			ServerResponse: googleapi.ServerResponse{
+				HTTPStatusCode: http.StatusOK,
+			},
+		},
+	)
+
+	ctx := context.Background()
+	statusResponse, err := p.Status(ctx, &StatusRequest{})
+	if err != nil {
+		t.Fatalf("Status failed, error: %v", err)
+	}
+	if statusResponse.Healthz != ok || statusResponse.KeyId != keyVersionName+":"+keySuffix {
+		t.Fatalf("Got Healthz %q and KeyId %q, want %q and %q", statusResponse.Healthz, statusResponse.KeyId, ok, keyVersionName+":"+keySuffix)
+	}
+
+	// The public key is cached, so encryption does not need any more responses from FakeKMS.
+	encryptResponse, err := p.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("foo")})
+	if err != nil {
+		t.Fatalf("Failed to encrypt, error: %v", err)
+	}
+	plain, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, encryptResponse.Ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Failed to decrypt with the private key, error: %v", err)
+	}
+	if string(plain) != "foo" {
+		t.Fatalf("Got %q after decryption with the private key, want %q", plain, "foo")
+	}
+
+	// 190 bytes is the most RSA-OAEP with a 2048 bit key and SHA-256 can encrypt.
+	if _, err := p.Encrypt(ctx, &EncryptRequest{Plaintext: make([]byte, 190)}); err != nil {
+		t.Fatalf("Failed to encrypt a payload of the maximum size, error: %v", err)
+	}
+	if _, err := p.Encrypt(ctx, &EncryptRequest{Plaintext: make([]byte, 191)}); err == nil {
+		t.Fatal("Expected encrypt of a payload exceeding the maximum size to fail")
+	}
+
+	decryptResponse, err := p.Decrypt(ctx, &DecryptRequest{Ciphertext: encryptResponse.Ciphertext, KeyId: encryptResponse.KeyId})
+	if err != nil {
+		t.Fatalf("Failed to decrypt, error: %v", err)
+	}
+	if string(decryptResponse.Plaintext) != "foo" {
+		t.Fatalf("Got %q after decryption, want %q", decryptResponse.Plaintext, "foo")
+	}
+
+	// Cloud KMS did not verify the checksum of the ciphertext.
+	_, err = p.Decrypt(ctx, &DecryptRequest{Ciphertext: encryptResponse.Ciphertext, KeyId: encryptResponse.KeyId})
+	if !plugin.IsIntegrityError(err) {
+		t.Fatalf("Got %v, want an integrity error", err)
+	}
+}
+
+func TestAsymmetricPluginPublicKey(t *testing.T) {
+	t.Parallel()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key, error: %v", err)
+	}
+
+	testCases := []struct {
+		desc             string
+		algorithm        string
+		pemCRC32CDelta   int64
+		wantIntegrityErr bool
+	}{
+		{
+			desc:      "Unsupported algorithm",
+			algorithm: "RSA_SIGN_PSS_2048_SHA256",
+		},
+		{
+			desc:             "Public key corrupted in transit",
+			algorithm:        "RSA_DECRYPT_OAEP_2048_SHA256",
+			pemCRC32CDelta:   1,
+			wantIntegrityErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.desc, func(t *testing.T) {
+			t.Parallel()
+
+			p := setUpAsymmetric(t, privateKey, testCase.algorithm, testCase.pemCRC32CDelta)
+			_, err := p.Encrypt(context.Background(), &EncryptRequest{Plaintext: []byte("foo")})
+			if err == nil {
+				t.Fatal("Expected encrypt to fail")
+			}
+			if got := plugin.IsIntegrityError(err); got != testCase.wantIntegrityErr {
+				t.Fatalf("Got integrity error %t for %v, want %t", got, err, testCase.wantIntegrityErr)
+			}
+		})
+	}
+}
+
+func TestAsymmetricPluginStatus(t *testing.T) {
+	t.Parallel()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key, error: %v", err)
+	}
+
+	testCases := []struct {
+		desc        string
+		response    json.Marshaler
+		wantHealthz string
+		// wantEncrypt is whether Encrypt still succeeds, FakeKMS has no more responses by then.
+		wantEncrypt bool
+	}{
+		{
+			desc:        "Key version enabled",
+			response:    publicKeyResponse(t, privateKey, "RSA_DECRYPT_OAEP_2048_SHA256", 0),
+			wantHealthz: ok,
+			wantEncrypt: true,
+		},
+		{
+			desc: "Key version disabled",
+			response: &fakekms.ErrorResponse{
+				Code:    http.StatusBadRequest,
+				Status:  "FAILED_PRECONDITION",
+				Message: keyVersionName + " is not enabled, current state is: DISABLED.",
+			},
+			wantHealthz: keyDisabled,
+		},
+		{
+			desc: "Key version destroyed",
+			response: &fakekms.ErrorResponse{
+				Code:    http.StatusNotFound,
+				Status:  "NOT_FOUND",
+				Message: keyVersionName + " not found.",
+			},
+			wantHealthz: keyDisabled,
+		},
+		{
+			desc: "Cloud KMS unavailable",
+			response: &fakekms.ErrorResponse{
+				Code:    http.StatusServiceUnavailable,
+				Status:  "UNAVAILABLE",
+				Message: "The service is currently unavailable.",
+			},
+			wantHealthz: keyNotReachable,
+			wantEncrypt: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			p := setUpAsymmetric(t, privateKey, "RSA_DECRYPT_OAEP_2048_SHA256", 0, testCase.response)
+
+			// The first Status fetches the public key, the second finds out about the state of the key version.
+			for _, wantHealthz := range []string{ok, testCase.wantHealthz} {
+				resp, err := p.Status(ctx, &StatusRequest{})
+				if err != nil {
+					t.Fatalf("Status failed, error: %v", err)
+				}
+				if resp.Healthz != wantHealthz {
+					t.Fatalf("Got Healthz %q, want %q", resp.Healthz, wantHealthz)
+				}
+			}
+
+			_, err := p.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("foo")})
+			if got := err == nil; got != testCase.wantEncrypt {
+				t.Fatalf("Got encrypt error %v, want success %t", err, testCase.wantEncrypt)
+			}
+		})
+	}
+}
+
+func TestAsymmetricPluginCoalescedDecrypt(t *testing.T) {
+	t.Parallel()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key, error: %v", err)
+	}
+	// FakeKMS serves a single decryption, the plugin must not call it again for identical requests.
+	p := setUpAsymmetricWithDelay(t, privateKey, "RSA_DECRYPT_OAEP_2048_SHA256", 0, 500*time.Millisecond,
+		&cloudkms.AsymmetricDecryptResponse{
+			Plaintext:                plaintext,
+			PlaintextCrc32c:          plaintextCRC32C,
+			VerifiedCiphertextCrc32c: true,
+			ServerResponse: googleapi.ServerResponse{
+				HTTPStatusCode: http.StatusOK,
+			},
+		},
+	)
+
+	if _, err := p.Status(context.Background(), &StatusRequest{}); err != nil {
+		t.Fatalf("Status failed, error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := p.Decrypt(context.Background(), &DecryptRequest{Ciphertext: []byte("bar"), KeyId: keyVersionName})
+			if err == nil && string(resp.Plaintext) != "foo" {
+				err = fmt.Errorf("got %q after decryption, want %q", resp.Plaintext, "foo")
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Failed to decrypt, error: %v", err)
+		}
+	}
+}
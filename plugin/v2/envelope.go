@@ -0,0 +1,191 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/plugin"
+)
+
+const (
+	// encryptedDEKAnnotationKey is the EncryptResponse annotation carrying the
+	// Cloud KMS wrapped data encryption key used to encrypt the payload locally.
+	encryptedDEKAnnotationKey = "encrypted-dek.cloudkms.k8s.io"
+
+	dekSize = 32
+	// maxDEKUsage caps the number of payloads sealed with a single DEK, well below
+	// the 2^32 limit recommended for AES-GCM with random nonces.
+	maxDEKUsage = 1 << 30
+
+	unwrappedDEKCacheSize = 1000
+	unwrappedDEKCacheTTL  = time.Hour
+)
+
+// dataKey is a locally generated data encryption key together with its Cloud KMS wrapped form.
+type dataKey struct {
+	aead    cipher.AEAD
+	wrapped []byte
+	// replicas is the replicas annotation of the DEK wrapped with the replica keys, if any.
+	replicas []byte
+	keyID    string
+	created  time.Time
+	usage    uint64
+}
+
+// expired reports whether the DEK must be replaced before it is used again, either because it
+// reached its lifetime or usage limit or because the primary key version has changed since it was wrapped.
+func (d *dataKey) expired(keyID string, lifetime time.Duration) bool {
+	return d.keyID != keyID || d.usage >= maxDEKUsage || time.Since(d.created) >= lifetime
+}
+
+// encryptLocally seals the payload with the current DEK and returns the wrapped DEK in the annotations.
+func (g *Plugin) encryptLocally(ctx context.Context, request *EncryptRequest) (*EncryptResponse, error) {
+	dek, err := g.currentDEK(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, dek.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce, error: %w", err)
+	}
+
+	glog.V(4).Infof("Processed request for local encryption %s using %s", request.Uid, dek.keyID)
+
+	annotations := g.annotations(dek.replicas)
+	if annotations == nil {
+		annotations = make(map[string][]byte)
+	}
+	annotations[encryptedDEKAnnotationKey] = dek.wrapped
+
+	return &EncryptResponse{
+		Ciphertext:  dek.aead.Seal(nonce, nonce, request.Plaintext, nil),
+		KeyId:       dek.keyID,
+		Annotations: annotations,
+	}, nil
+}
+
+// currentDEK returns the DEK to seal the next payload with, generating and wrapping a new one
+// with Cloud KMS when there is none yet or the previous one has expired.
+func (g *Plugin) currentDEK(ctx context.Context) (*dataKey, error) {
+	g.dekLock.Lock()
+	defer g.dekLock.Unlock()
+
+	if d := g.dek; d != nil && !d.expired(g.keyID(), g.dekLifetime) {
+		d.usage++
+		return d, nil
+	}
+
+	key := make([]byte, dekSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate data encryption key, error: %w", err)
+	}
+
+	settings := g.key.Load()
+	name, wrapped, err := g.encryptWithKey(ctx, settings.uri, key)
+	if err != nil {
+		return nil, err
+	}
+
+	replicas, err := g.wrapReplicas(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &dataKey{
+		aead:     aead,
+		wrapped:  wrapped,
+		replicas: replicas,
+		keyID:    g.setKeyID(settings, name),
+		created:  time.Now(),
+		usage:    1,
+	}
+	g.dek = d
+	g.unwrappedDEKs.Add(dekCacheKey(wrapped), aead, unwrappedDEKCacheTTL)
+	glog.V(4).Infof("Generated a new data encryption key wrapped with %s", d.keyID)
+
+	return d, nil
+}
+
+// decryptLocally unwraps the DEK (or takes it from the cache) and opens the payload with it.
+// The DEK is wrapped with the additional authenticated data, if any.
+func (g *Plugin) decryptLocally(ctx context.Context, keyResourceName string, wrapped, ciphertext, aad []byte, annotations map[string][]byte) (*DecryptResponse, error) {
+	aead, err := g.unwrapDEK(ctx, keyResourceName, wrapped, aad, annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, fmt.Errorf("%w: it is shorter than the nonce", plugin.ErrInvalidCiphertext)
+	}
+
+	plain, err := aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt it with the data encryption key, error: %v", plugin.ErrInvalidCiphertext, err)
+	}
+
+	return &DecryptResponse{
+		Plaintext: plain,
+	}, nil
+}
+
+func (g *Plugin) unwrapDEK(ctx context.Context, keyResourceName string, wrapped, aad []byte, annotations map[string][]byte) (cipher.AEAD, error) {
+	cacheKey := dekCacheKey(wrapped)
+	if v, ok := g.unwrappedDEKs.Get(cacheKey); ok {
+		return v.(cipher.AEAD), nil
+	}
+
+	key, err := g.decryptWithReplicas(ctx, keyResourceName, wrapped, aad, annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	g.unwrappedDEKs.Add(cacheKey, aead, unwrappedDEKCacheTTL)
+
+	return aead, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher, error: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// dekCacheKey avoids keeping the wrapped DEKs themselves as cache keys.
+func dekCacheKey(wrapped []byte) string {
+	sum := sha256.Sum256(wrapped)
+	return string(sum[:])
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/plugin"
+	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/testutils/fakekms"
+)
+
+func setUpWithPipethrough(t *testing.T, opts ...Option) *pluginTestCase {
+	t.Helper()
+	fakeKMSSrv, err := fakekms.NewWithPipethrough(keyName, 0)
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	tt := setUp(t, fakeKMSSrv, keyName, "", opts...)
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+	return tt
+}
+
+func TestLocalEncryption(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tt := setUpWithPipethrough(t, WithLocalEncryption(time.Hour))
+
+	var responses []*EncryptResponse
+	for _, plain := range []string{"foo", "bar"} {
+		resp, err := tt.plugin.Encrypt(ctx, &EncryptRequest{Plaintext: []byte(plain)})
+		if err != nil {
+			t.Fatalf("Failed to encrypt %q, error: %v", plain, err)
+		}
+		if _, ok := resp.Annotations[encryptedDEKAnnotationKey]; !ok {
+			t.Fatalf("Expected %q annotation in the response, got %v", encryptedDEKAnnotationKey, resp.Annotations)
+		}
+		responses = append(responses, resp)
+	}
+
+	if got := tt.fakeKMSSrv.EncryptRequestsCount(); got != 1 {
+		t.Fatalf("Got %d encrypt requests to Cloud KMS, want 1", got)
+	}
+
+	// The DEK is cached when it is generated, a fresh plugin has to unwrap it via Cloud KMS.
+	fresh := NewPlugin(tt.plugin.keyService, keyName, "")
+	for i, p := range []*Plugin{tt.plugin, fresh} {
+		resp, err := p.Decrypt(ctx, &DecryptRequest{
+			Ciphertext:  responses[0].Ciphertext,
+			KeyId:       responses[0].KeyId,
+			Annotations: responses[0].Annotations,
+		})
+		if err != nil {
+			t.Fatalf("Failed to decrypt, error: %v", err)
+		}
+		if !bytes.Equal(resp.Plaintext, []byte("foo")) {
+			t.Fatalf("Got %q after decryption, want %q", resp.Plaintext, "foo")
+		}
+		if got := tt.fakeKMSSrv.DecryptRequestsCount(); got != i {
+			t.Fatalf("Got %d decrypt requests to Cloud KMS, want %d", got, i)
+		}
+	}
+	// Corrupt and truncated payloads are rejected as invalid, rather than as unknown errors.
+	corrupt := bytes.Clone(responses[1].Ciphertext)
+	corrupt[len(corrupt)-1] ^= 1
+	for _, ciphertext := range [][]byte{corrupt, responses[1].Ciphertext[:4]} {
+		_, err := tt.plugin.Decrypt(ctx, &DecryptRequest{
+			Ciphertext:  ciphertext,
+			KeyId:       responses[1].KeyId,
+			Annotations: responses[1].Annotations,
+		})
+		if got := status.Code(plugin.StatusError(err)); got != codes.InvalidArgument {
+			t.Fatalf("Got %v for a corrupt payload, want %v", err, codes.InvalidArgument)
+		}
+	}
+}
+
+func TestLocalEncryptionDEKExpiry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tt := setUpWithPipethrough(t, WithLocalEncryption(0))
+
+	for i := 1; i <= 2; i++ {
+		if _, err := tt.plugin.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("foo")}); err != nil {
+			t.Fatalf("Failed to encrypt, error: %v", err)
+		}
+		if got := tt.fakeKMSSrv.EncryptRequestsCount(); got != i {
+			t.Fatalf("Got %d encrypt requests to Cloud KMS, want %d", got, i)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package v2
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 
@@ -26,10 +27,27 @@ import (
 
 var _ plugin.HealthChecker = (*HealthChecker)(nil)
 
-type HealthChecker struct{}
+type HealthChecker struct {
+	checkKeyID bool
+}
+
+// HealthCheckerOption configures HealthChecker.
+type HealthCheckerOption func(*HealthChecker)
 
-func NewHealthChecker() *HealthChecker {
-	return &HealthChecker{}
+// WithKeyIDCheck makes PingKMS also fail unless Status reports the key ID Encrypt used, ex. when Status
+// is answered from a key version that is no longer primary. It may fail briefly after the key is rotated.
+func WithKeyIDCheck() HealthCheckerOption {
+	return func(h *HealthChecker) {
+		h.checkKeyID = true
+	}
+}
+
+func NewHealthChecker(opts ...HealthCheckerOption) *HealthChecker {
+	h := &HealthChecker{}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 func (h *HealthChecker) PingRPC(ctx context.Context, conn *grpc.ClientConn) error {
@@ -43,23 +61,42 @@ func (h *HealthChecker) PingRPC(ctx context.Context, conn *grpc.ClientConn) erro
 	return nil
 }
 
+// PingKMS encrypts a payload and checks that it decrypts back to the same bytes.
 func (h *HealthChecker) PingKMS(ctx context.Context, conn *grpc.ClientConn) error {
 	client := NewKeyManagementServiceClient(conn)
 
+	plain := []byte("secret")
 	encryptResponse, err := client.Encrypt(ctx, &EncryptRequest{
 		Uid:       uuid.NewString(),
-		Plaintext: []byte("secret"),
+		Plaintext: plain,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to ping KMS: %w", err)
 	}
 
-	if _, err = client.Decrypt(ctx, &DecryptRequest{
-		Uid:        uuid.NewString(),
-		Ciphertext: []byte(encryptResponse.Ciphertext),
-	}); err != nil {
+	decryptResponse, err := client.Decrypt(ctx, &DecryptRequest{
+		Uid:         uuid.NewString(),
+		Ciphertext:  encryptResponse.Ciphertext,
+		KeyId:       encryptResponse.KeyId,
+		Annotations: encryptResponse.Annotations,
+	})
+	if err != nil {
 		return fmt.Errorf("failed to ping KMS: %w", err)
 	}
+	if !bytes.Equal(decryptResponse.Plaintext, plain) {
+		return fmt.Errorf("failed to ping KMS: payload encrypted with key ID %q decrypted to different bytes", encryptResponse.KeyId)
+	}
+
+	if !h.checkKeyID {
+		return nil
+	}
+	statusResponse, err := client.Status(ctx, &StatusRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to retrieve status from gRPC endpoint: %w", err)
+	}
+	if statusResponse.KeyId != encryptResponse.KeyId {
+		return fmt.Errorf("key ID %q reported by Status differs from %q used by Encrypt", statusResponse.KeyId, encryptResponse.KeyId)
+	}
 
 	return nil
 }
@@ -15,22 +15,29 @@
 package v2
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	fmt "fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"google.golang.org/api/cloudkms/v1"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 
 	"github.com/phayes/freeport"
 
 	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/plugin"
+	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/testutils/fakekms"
 )
 
 func TestHealthzServer(t *testing.T) {
@@ -52,6 +59,14 @@ func TestHealthzServer(t *testing.T) {
 				HTTPStatusCode: http.StatusOK,
 			},
 		}
+		// The ping decrypts back to the payload it encrypted.
+		pingDecryptResponse = &cloudkms.DecryptResponse{
+			Plaintext:       base64.StdEncoding.EncodeToString([]byte("secret")),
+			PlaintextCrc32c: plugin.CRC32C([]byte("secret")),
+			ServerResponse: googleapi.ServerResponse{
+				HTTPStatusCode: http.StatusOK,
+			},
+		}
 	)
 
 	testCases := []struct {
@@ -75,9 +90,15 @@ func TestHealthzServer(t *testing.T) {
 		{
 			desc:     "Positive response for TestIAM, Positive ping from CloudKMS",
 			query:    "ping-kms=true",
-			response: []json.Marshaler{positiveTestIAMResponse, positiveEncryptResponse, positiveDecryptResponse},
+			response: []json.Marshaler{positiveTestIAMResponse, positiveEncryptResponse, pingDecryptResponse},
 			want:     http.StatusOK,
 		},
+		{
+			desc:     "Positive response for TestIAM, ping from CloudKMS decrypts to different bytes",
+			query:    "ping-kms=true",
+			response: []json.Marshaler{positiveTestIAMResponse, positiveEncryptResponse, positiveDecryptResponse},
+			want:     http.StatusServiceUnavailable,
+		},
 		{
 			desc:     "Positive response for TestIAM, Negative ping from CloudKMS",
 			query:    "ping-kms=true",
@@ -114,6 +135,296 @@ func TestHealthzServer(t *testing.T) {
 	}
 }
 
+func TestLivezAndReadyz(t *testing.T) {
+	t.Parallel()
+
+	negativeTestIAMResponse := &cloudkms.TestIamPermissionsResponse{
+		Permissions: []string{},
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: http.StatusOK,
+		},
+	}
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyName, 0, 0, negativeTestIAMResponse, negativeTestIAMResponse)
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	// Polling keeps Status from calling FakeKMS.
+	tt := setUp(t, fakeKMSSrv, keyName, "", WithKeyVersionPolling(time.Hour, time.Second))
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+	healthzPort := mustServeHealthz(t, tt)
+
+	// The checks are run in order, each IAM check consumes a response of FakeKMS.
+	testCases := []struct {
+		path string
+		want int
+	}{
+		{path: "livez", want: http.StatusOK},
+		{path: "livez/socket", want: http.StatusOK},
+		{path: "readyz/socket", want: http.StatusOK},
+		{path: "readyz/grpc", want: http.StatusOK},
+		{path: "readyz", want: http.StatusForbidden},
+		{path: "readyz/iam", want: http.StatusForbidden},
+		{path: "readyz/unknown", want: http.StatusNotFound},
+		{path: "livez/iam", want: http.StatusNotFound},
+	}
+
+	for _, testCase := range testCases {
+		u := url.URL{
+			Scheme: "http",
+			Host:   net.JoinHostPort("localhost", strconv.Itoa(healthzPort)),
+			Path:   testCase.path,
+		}
+		gotStatus, gotBody := mustGetHealthz(t, u)
+		if gotStatus != testCase.want {
+			t.Fatalf("Got %d for /%s status, want %d, response: %q", gotStatus, testCase.path, testCase.want, gotBody)
+		}
+	}
+}
+
+func TestCachedHealthz(t *testing.T) {
+	t.Parallel()
+
+	positiveTestIAMResponse := &cloudkms.TestIamPermissionsResponse{
+		Permissions: []string{
+			"cloudkms.cryptoKeyVersions.useToDecrypt",
+			"cloudkms.cryptoKeyVersions.useToEncrypt",
+		},
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: http.StatusOK,
+		},
+	}
+	// A single IAM response, any further TestIamPermissions call fails.
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyName, 0, 0, positiveTestIAMResponse)
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	// Polling keeps Status from calling FakeKMS.
+	tt := setUp(t, fakeKMSSrv, keyName, "", WithKeyVersionPolling(time.Hour, time.Second))
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+	healthzPort := mustServeHealthz(t, tt, func(m *plugin.HealthCheckerManager) {
+		m.SetCheckInterval(time.Hour)
+	})
+
+	for _, path := range []string{"healthz", "readyz", "readyz/iam", "healthz"} {
+		u := url.URL{
+			Scheme: "http",
+			Host:   net.JoinHostPort("localhost", strconv.Itoa(healthzPort)),
+			Path:   path,
+		}
+		gotStatus, gotBody := mustGetHealthz(t, u)
+		if gotStatus != http.StatusOK {
+			t.Fatalf("Got %d for /%s status, want %d, response: %q", gotStatus, path, http.StatusOK, gotBody)
+		}
+	}
+
+	// kms has no result yet, so it is run on the spot and fails once FakeKMS is out of responses.
+	u := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort("localhost", strconv.Itoa(healthzPort)),
+		Path:   "readyz/kms",
+	}
+	gotStatus, gotBody := mustGetHealthz(t, u)
+	if gotStatus != http.StatusServiceUnavailable {
+		t.Fatalf("Got %d for /readyz/kms status, want %d, response: %q", gotStatus, http.StatusServiceUnavailable, gotBody)
+	}
+	if want := "never passed"; !strings.Contains(string(gotBody), want) {
+		t.Fatalf("Got %q for /readyz/kms response, want it to contain %q", gotBody, want)
+	}
+}
+
+func TestHealthzReport(t *testing.T) {
+	t.Parallel()
+
+	positiveTestIAMResponse := &cloudkms.TestIamPermissionsResponse{
+		Permissions: []string{
+			"cloudkms.cryptoKeyVersions.useToDecrypt",
+			"cloudkms.cryptoKeyVersions.useToEncrypt",
+		},
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: http.StatusOK,
+		},
+	}
+	negativeTestIAMResponse := &cloudkms.TestIamPermissionsResponse{
+		Permissions: []string{},
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: http.StatusOK,
+		},
+	}
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyName, 0, 0, positiveTestIAMResponse, negativeTestIAMResponse)
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	// Polling keeps Status from calling FakeKMS.
+	tt := setUp(t, fakeKMSSrv, keyName, "", WithKeyVersionPolling(time.Hour, time.Second))
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+	healthzPort := mustServeHealthz(t, tt)
+
+	u := url.URL{
+		Scheme:   "http",
+		Host:     net.JoinHostPort("localhost", strconv.Itoa(healthzPort)),
+		Path:     "readyz",
+		RawQuery: "verbose",
+	}
+	gotStatus, gotBody := mustGetHealthz(t, u)
+	if gotStatus != http.StatusOK {
+		t.Fatalf("Got %d for /readyz?verbose status, want %d, response: %q", gotStatus, http.StatusOK, gotBody)
+	}
+	for _, want := range []string{"[+]socket ok", "[+]grpc ok", "[+]iam ok", "readyz check passed"} {
+		if !strings.Contains(string(gotBody), want) {
+			t.Fatalf("Got %q for /readyz?verbose response, want it to contain %q", gotBody, want)
+		}
+	}
+
+	u.RawQuery = "format=json"
+	gotStatus, gotBody = mustGetHealthz(t, u)
+	if gotStatus != http.StatusForbidden {
+		t.Fatalf("Got %d for /readyz?format=json status, want %d, response: %q", gotStatus, http.StatusForbidden, gotBody)
+	}
+	var report struct {
+		OK     bool `json:"ok"`
+		Checks []struct {
+			Name  string `json:"name"`
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		} `json:"checks"`
+	}
+	if err := json.Unmarshal(gotBody, &report); err != nil {
+		t.Fatalf("Failed to decode /readyz?format=json response %q, error: %v", gotBody, err)
+	}
+	if report.OK {
+		t.Fatalf("Got ok for /readyz?format=json, want it to fail, response: %q", gotBody)
+	}
+	for _, c := range report.Checks {
+		if wantOK := c.Name != "iam"; c.OK != wantOK || (c.Error == "") != wantOK {
+			t.Fatalf("Got ok %v and error %q for check %s, want ok %v", c.OK, c.Error, c.Name, wantOK)
+		}
+	}
+}
+
+func TestKeyStateHealthz(t *testing.T) {
+	t.Parallel()
+
+	keyResponse := func(state string) *cloudkms.CryptoKey {
+		return &cloudkms.CryptoKey{
+			Name:             keyName,
+			Purpose:          "ENCRYPT_DECRYPT",
+			NextRotationTime: "2026-01-01T00:00:00Z",
+			Primary: &cloudkms.CryptoKeyVersion{
+				Name:            keyVersionName,
+				State:           state,
+				ProtectionLevel: "HSM",
+				DestroyTime:     "2025-01-01T00:00:00Z",
+			},
+			ServerResponse: googleapi.ServerResponse{
+				HTTPStatusCode: http.StatusOK,
+			},
+		}
+	}
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyName, 0, 0, keyResponse("ENABLED"), keyResponse("DESTROY_SCHEDULED"))
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	// Polling keeps Status from calling FakeKMS, the poller is not started.
+	tt := setUp(t, fakeKMSSrv, keyName, "", WithKeyVersionPolling(time.Hour, time.Second))
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+	healthzPort := mustServeHealthz(t, tt, func(m *plugin.HealthCheckerManager) {
+		m.SetKeyStateCheck(true)
+	})
+
+	testCases := []struct {
+		desc     string
+		want     int
+		wantBody string
+	}{
+		{
+			desc:     "Primary version is enabled",
+			want:     http.StatusOK,
+			wantBody: "purpose ENCRYPT_DECRYPT, primary version " + keyVersionName + " is ENABLED, protection level HSM, next rotation at 2026-01-01T00:00:00Z",
+		},
+		{
+			desc:     "Primary version is scheduled for destruction",
+			want:     http.StatusServiceUnavailable,
+			wantBody: "scheduled for destruction at 2025-01-01T00:00:00Z",
+		},
+	}
+
+	for _, testCase := range testCases {
+		u := url.URL{
+			Scheme:   "http",
+			Host:     net.JoinHostPort("localhost", strconv.Itoa(healthzPort)),
+			Path:     "readyz/key-state",
+			RawQuery: "verbose",
+		}
+		gotStatus, gotBody := mustGetHealthz(t, u)
+		if gotStatus != testCase.want {
+			t.Fatalf("%s: got %d for /readyz/key-state status, want %d, response: %q", testCase.desc, gotStatus, testCase.want, gotBody)
+		}
+		if !strings.Contains(string(gotBody), testCase.wantBody) {
+			t.Fatalf("%s: got %q for /readyz/key-state response, want it to contain %q", testCase.desc, gotBody, testCase.wantBody)
+		}
+	}
+}
+
+// staleStatusPlugin reports a key ID in Status that Encrypt no longer uses.
+type staleStatusPlugin struct {
+	*Plugin
+}
+
+func (p staleStatusPlugin) Register(s *grpc.Server) {
+	RegisterKeyManagementServiceServer(s, p)
+}
+
+func (p staleStatusPlugin) Status(context.Context, *StatusRequest) (*StatusResponse, error) {
+	return &StatusResponse{Version: apiVersion, KeyId: "stale", Healthz: ok}, nil
+}
+
+func TestPingKMSKeyID(t *testing.T) {
+	t.Parallel()
+
+	tt := setUpWithPipethrough(t)
+	socket := filepath.Join(t.TempDir(), "stale.sock")
+	stale := plugin.NewManager(staleStatusPlugin{tt.plugin}, socket)
+	staleSrv, errCh := stale.Start()
+	t.Cleanup(staleSrv.GracefulStop)
+	select {
+	case err := <-errCh:
+		t.Fatalf("Failed to start the plugin, error: %v", err)
+	case <-time.After(time.Second):
+	}
+
+	testCases := []struct {
+		desc    string
+		socket  string
+		opts    []HealthCheckerOption
+		wantErr bool
+	}{
+		{desc: "Round trip", socket: tt.socket},
+		{desc: "Status reports the key ID of Encrypt", socket: tt.socket, opts: []HealthCheckerOption{WithKeyIDCheck()}},
+		{desc: "Key IDs are not compared by default", socket: socket},
+		{desc: "Status reports another key ID", socket: socket, opts: []HealthCheckerOption{WithKeyIDCheck()}, wantErr: true},
+	}
+
+	for _, testCase := range testCases {
+		conn, err := grpc.NewClient("unix:"+testCase.socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatalf("%s: failed to connect to the plugin, error: %v", testCase.desc, err)
+		}
+		err = NewHealthChecker(testCase.opts...).PingKMS(context.Background(), conn)
+		conn.Close()
+		if (err != nil) != testCase.wantErr {
+			t.Fatalf("%s: got error %v, want error %v", testCase.desc, err, testCase.wantErr)
+		}
+	}
+}
+
 func mustGetHealthz(t *testing.T, url url.URL) (int, []byte) {
 	t.Helper()
 	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
@@ -133,7 +444,7 @@ func mustGetHealthz(t *testing.T, url url.URL) (int, []byte) {
 	return resp.StatusCode, b
 }
 
-func mustServeHealthz(t *testing.T, tt *pluginTestCase) int {
+func mustServeHealthz(t *testing.T, tt *pluginTestCase, opts ...func(*plugin.HealthCheckerManager)) int {
 	t.Helper()
 
 	p, err := freeport.GetFreePort()
@@ -147,7 +458,13 @@ func mustServeHealthz(t *testing.T, tt *pluginTestCase) int {
 	}
 
 	healthChecker := NewHealthChecker()
-	healthCheckerManager := plugin.NewHealthChecker(healthChecker, tt.plugin.keyURI, tt.plugin.keyService, tt.socket, 5*time.Second, u)
+	healthCheckerManager := plugin.NewHealthChecker(healthChecker, tt.plugin.key.Load().uri, tt.plugin.keyService, tt.socket, 5*time.Second, u)
+	for _, opt := range opts {
+		opt(healthCheckerManager)
+	}
+	t.Cleanup(func() {
+		healthCheckerManager.Shutdown(context.Background())
+	})
 
 	c := healthCheckerManager.Serve()
 
@@ -16,14 +16,23 @@
 package v2
 
 import (
+	"maps"
 	"regexp"
+	"slices"
 	"sync"
+	"sync/atomic"
 
 	"google.golang.org/api/cloudkms/v1"
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/cache"
 
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"time"
 
@@ -37,6 +46,11 @@ const (
 	ping            = "cGluZw=="
 	keyNotReachable = "Cloud KMS key is not reachable"
 	keyDisabled     = "Cloud KMS key is not enabled or no cloudkms.cryptoKeys.get permission"
+	circuitOpen     = "Cloud KMS is unavailable, circuit breaker is open"
+
+	// aadAnnotationKey is the EncryptResponse annotation carrying the additional authenticated data
+	// the payload was encrypted with.
+	aadAnnotationKey = "aad.cloudkms.k8s.io"
 )
 
 // Regex to extract Cloud KMS key resource name from the key version resource name
@@ -46,8 +60,23 @@ var _ plugin.Plugin = (*Plugin)(nil)
 
 type Plugin struct {
 	keyService *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService
-	keyURI     string
-	keySuffix  string
+	// key is the key to encrypt with, swapped by SetKey.
+	key atomic.Pointer[keySettings]
+	// aad is sent as additional authenticated data with every encrypt and decrypt call so that
+	// ciphertexts are bound to this cluster.
+	aad []byte
+	// decryptKeyURIs are historical keys to fall back to when the key referenced by
+	// the request (or keyURI) cannot decrypt the ciphertext.
+	decryptKeyURIs []string
+	// backoff configures retries of Cloud KMS calls.
+	backoff plugin.Backoff
+	// breaker fails Cloud KMS calls fast while Cloud KMS is unavailable.
+	breaker *plugin.CircuitBreaker
+	// replicaKeyURIs are keys, typically in other locations, that every payload is additionally
+	// wrapped with so that it can be decrypted while the location of keyURI is unavailable.
+	replicaKeyURIs []string
+	// minReplicas is the number of replica copies Encrypt requires, -1 requires all of them.
+	minReplicas int
 
 	// lastKeyID stores the last known primary key version resource name to return
 	// as KeyId in case when the Cloud KMS service is not reachable because KeyId
@@ -55,20 +84,145 @@ type Plugin struct {
 	// case of transient remote service unavailability.
 	lastKeyID     string
 	lastKeyIDLock sync.RWMutex
+
+	// keyPollInterval enables polling of the primary key version in the background, in which case
+	// Status answers with lastKeyID and lastHealthz instead of calling Cloud KMS.
+	keyPollInterval time.Duration
+	keyPollTimeout  time.Duration
+	lastHealthz     string
+
+	// localEncryption enables envelope encryption with a locally generated DEK
+	// which is wrapped by Cloud KMS once per dekLifetime.
+	localEncryption bool
+	dekLifetime     time.Duration
+	dek             *dataKey
+	dekLock         sync.Mutex
+	// unwrappedDEKs caches DEKs unwrapped by Cloud KMS, keyed by the hash of the wrapped DEK.
+	unwrappedDEKs *cache.LRUExpireCache
+
+	// decryptCache is an optional cache of decrypted payloads keyed by the hash of KeyId and
+	// Ciphertext. It is dropped whenever the key ID changes.
+	decryptCache    *cache.LRUExpireCache
+	decryptCacheTTL time.Duration
+
+	// decrypts coalesces concurrent identical Decrypt requests into one.
+	decrypts plugin.Flight
+}
+
+// keySettings are the settings of the key to encrypt with.
+type keySettings struct {
+	uri    string
+	suffix string
+}
+
+// Option configures optional behaviour of Plugin.
+type Option func(*Plugin)
+
+// WithLocalEncryption makes Encrypt seal payloads locally with an AES-GCM data encryption key,
+// which is wrapped by Cloud KMS and replaced after dekLifetime or once the primary key version changes.
+func WithLocalEncryption(dekLifetime time.Duration) Option {
+	return func(p *Plugin) {
+		p.localEncryption = true
+		p.dekLifetime = dekLifetime
+	}
+}
+
+// WithDecryptCache enables caching of up to size decrypted payloads for ttl, so that repeated reads
+// of the same object (ex. on kube-apiserver restart) do not result in calls to Cloud KMS.
+func WithDecryptCache(size int, ttl time.Duration) Option {
+	return func(p *Plugin) {
+		p.decryptCache = cache.NewLRUExpireCache(size)
+		p.decryptCacheTTL = ttl
+	}
+}
+
+// WithDecryptKeyURIs configures keys that Decrypt falls back to, in order, when the primary key cannot
+// decrypt the ciphertext. This allows moving to a new key ring or project without re-encrypting the data first.
+func WithDecryptKeyURIs(keyURIs ...string) Option {
+	return func(p *Plugin) {
+		p.decryptKeyURIs = keyURIs
+	}
+}
+
+// WithBackoff makes Cloud KMS calls that fail with a retryable error be retried according to b.
+func WithBackoff(b plugin.Backoff) Option {
+	return func(p *Plugin) {
+		p.backoff = b
+	}
+}
+
+// WithCircuitBreaker makes Cloud KMS calls fail fast while cb is open.
+func WithCircuitBreaker(cb *plugin.CircuitBreaker) Option {
+	return func(p *Plugin) {
+		p.breaker = cb
+	}
+}
+
+// WithReplicaKeyURIs makes Encrypt additionally wrap every payload with each of keyURIs and carry the
+// copies in the annotations, so that Decrypt succeeds as long as any one of the keys is reachable.
+func WithReplicaKeyURIs(keyURIs ...string) Option {
+	return func(p *Plugin) {
+		p.replicaKeyURIs = keyURIs
+	}
+}
+
+// WithMinReplicaCopies lets Encrypt succeed once n of the replica keys have wrapped the payload,
+// instead of all of them, so that writes remain available while a replica location is down.
+// Payloads written in the meantime lack the copies of the unavailable locations.
+func WithMinReplicaCopies(n int) Option {
+	return func(p *Plugin) {
+		p.minReplicas = n
+	}
+}
+
+// WithKeyVersionPolling makes Status report the primary key version read by PollKeyVersion
+// every interval, instead of encrypting a ping with Cloud KMS on every call.
+// Each read is bounded by timeout, so that a hung call is reported as unhealthy well before the next poll.
+func WithKeyVersionPolling(interval, timeout time.Duration) Option {
+	return func(p *Plugin) {
+		p.keyPollInterval = interval
+		p.keyPollTimeout = timeout
+	}
+}
+
+// WithAdditionalAuthenticatedData binds ciphertexts to aad (ex. a cluster UID), so that a ciphertext
+// copied from another cluster's etcd cannot be decrypted even if that cluster shares the key.
+func WithAdditionalAuthenticatedData(aad []byte) Option {
+	return func(p *Plugin) {
+		p.aad = aad
+	}
 }
 
 // New constructs Plugin.
-func NewPlugin(keyService *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService, keyURI, keySuffix string) *Plugin {
+func NewPlugin(keyService *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService, keyURI, keySuffix string, opts ...Option) *Plugin {
 	p := &Plugin{
-		keyService: keyService,
-		keyURI:     keyURI,
-		keySuffix:  keySuffix,
+		keyService:    keyService,
+		unwrappedDEKs: cache.NewLRUExpireCache(unwrappedDEKCacheSize),
+		lastHealthz:   ok,
+		minReplicas:   -1,
 	}
-	p.setKeyID(keyURI)
+	for _, opt := range opts {
+		opt(p)
+	}
+	key := &keySettings{uri: keyURI, suffix: keySuffix}
+	p.key.Store(key)
+	p.setKeyID(key, keyURI)
 
 	return p
 }
 
+// SetKey makes the plugin encrypt with keyURI and suffix key IDs with keySuffix from now on, ex. on
+// a configuration reload, while requests in progress complete with the previous key.
+// Payloads encrypted with the previous key remain decryptable with the key ID kube-apiserver passes.
+func (g *Plugin) SetKey(keyURI, keySuffix string) {
+	g.key.Store(&keySettings{uri: keyURI, suffix: keySuffix})
+
+	// The next payload is sealed with a DEK wrapped by the new key.
+	g.dekLock.Lock()
+	g.dek = nil
+	g.dekLock.Unlock()
+}
+
 // Register registers the plugin as a service management service.
 func (g *Plugin) Register(s *grpc.Server) {
 	RegisterKeyManagementServiceServer(s, g)
@@ -80,8 +234,21 @@ func (g *Plugin) Register(s *grpc.Server) {
 // kube-apiserver will provide this key version in Encrypt and Decrypt calls and will be able
 // to know whether the remote CLoud KMS key has been rotated or not.
 func (g *Plugin) Status(ctx context.Context, request *StatusRequest) (*StatusResponse, error) {
-	defer plugin.RecordCloudKMSOperation("encrypt", time.Now().UTC())
+	if g.keyPollInterval > 0 {
+		healthz := g.healthz()
+		if g.breaker.State() == plugin.CircuitOpen {
+			healthz = circuitOpen
+		}
+		return &StatusResponse{
+			Version: apiVersion,
+			KeyId:   g.keyID(),
+			Healthz: healthz,
+		}, nil
+	}
+
+	defer plugin.RecordCloudKMSOperation("status", time.Now().UTC())
 
+	key := g.key.Load()
 	keyID := g.keyID()
 
 	statusResp := &StatusResponse{
@@ -89,14 +256,22 @@ func (g *Plugin) Status(ctx context.Context, request *StatusRequest) (*StatusRes
 		KeyId:   keyID,
 		Healthz: ok,
 	}
-	resp, err := g.keyService.Encrypt(g.keyURI, &cloudkms.EncryptRequest{
+	// The ping is not retried, but it probes a half-open circuit breaker.
+	resp, err := plugin.Call(ctx, "status", plugin.Backoff{}, g.breaker, g.keyService.Encrypt(key.uri, &cloudkms.EncryptRequest{
 		Plaintext: ping,
-	}).Context(ctx).Do()
-	if err != nil {
-		plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("encrypt").Inc()
+	}).Context(ctx).Do)
+	switch {
+	case plugin.IsCircuitOpen(err):
+		statusResp.Healthz = circuitOpen
+	case status.Code(plugin.StatusError(err)) == codes.FailedPrecondition:
+		// Cloud KMS refuses to encrypt with a primary version that is not enabled.
+		plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("status").Inc()
+		statusResp.Healthz = keyDisabled
+	case err != nil:
+		plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("status").Inc()
 		statusResp.Healthz = keyNotReachable
-	} else {
-		g.setKeyID(resp.Name)
+	default:
+		g.setKeyID(key, resp.Name)
 	}
 
 	glog.V(4).Infof("Status response: %s", statusResp.Healthz)
@@ -105,53 +280,104 @@ func (g *Plugin) Status(ctx context.Context, request *StatusRequest) (*StatusRes
 
 // Encrypt encrypts payload provided by K8S API Server.
 func (g *Plugin) Encrypt(ctx context.Context, request *EncryptRequest) (*EncryptResponse, error) {
-	glog.V(4).Infof("Processing request for encryption %s using %s", request.Uid, g.keyURI)
-	defer plugin.RecordCloudKMSOperation("encrypt", time.Now().UTC())
+	key := g.key.Load()
+	glog.V(4).Infof("Processing request for encryption %s using %s", request.Uid, key.uri)
+
+	if g.localEncryption {
+		return g.encryptLocally(ctx, request)
+	}
 
-	resp, err := g.keyService.Encrypt(g.keyURI, &cloudkms.EncryptRequest{
-		Plaintext: base64.StdEncoding.EncodeToString(request.Plaintext),
-	}).Context(ctx).Do()
+	name, cipher, err := g.encryptWithKey(ctx, key.uri, request.Plaintext)
 	if err != nil {
-		plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("encrypt").Inc()
 		return nil, err
 	}
 
-	cipher, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	replicas, err := g.wrapReplicas(ctx, request.Plaintext)
 	if err != nil {
 		return nil, err
 	}
 
-	keyID := g.setKeyID(resp.Name)
+	keyID := g.setKeyID(key, name)
 
 	glog.V(4).Infof("Processed request for encryption %s using %s",
 		request.Uid, keyID)
 
 	return &EncryptResponse{
-		Ciphertext: cipher,
-		KeyId:      keyID,
+		Ciphertext:  cipher,
+		KeyId:       keyID,
+		Annotations: g.annotations(replicas),
 	}, nil
 }
 
 // Decrypt decrypts payload supplied by K8S API Server.
 func (g *Plugin) Decrypt(ctx context.Context, request *DecryptRequest) (*DecryptResponse, error) {
 	glog.V(4).Infof("Processing request for decryption %s using %s", request.Uid, request.KeyId)
-	defer plugin.RecordCloudKMSOperation("decrypt", time.Now().UTC())
 
-	keyResourceName := g.keyURI
+	if g.decryptCache == nil {
+		return g.coalescedDecrypt(ctx, request)
+	}
+
+	// Payloads bound to a different AAD are rejected even when they are in the cache.
+	if _, err := g.decryptAAD(request.Annotations); err != nil {
+		return nil, err
+	}
+
+	cacheKey := decryptCacheKey(request)
+	if plain, ok := g.decryptCache.Get(cacheKey); ok {
+		plugin.DecryptCacheHitsTotal.Inc()
+		return &DecryptResponse{
+			Plaintext: plain.([]byte),
+		}, nil
+	}
+	plugin.DecryptCacheMissesTotal.Inc()
+
+	resp, err := g.coalescedDecrypt(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	g.decryptCache.Add(cacheKey, resp.Plaintext, g.decryptCacheTTL)
+
+	return resp, nil
+}
+
+// coalescedDecrypt decrypts request, sharing a single call to Cloud KMS among concurrent identical requests.
+func (g *Plugin) coalescedDecrypt(ctx context.Context, request *DecryptRequest) (*DecryptResponse, error) {
+	plain, err := g.decrypts.Do(ctx, "decrypt", decryptFlightKey(request), func(ctx context.Context) ([]byte, error) {
+		resp, err := g.decrypt(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Plaintext, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DecryptResponse{
+		Plaintext: plain,
+	}, nil
+}
+
+func (g *Plugin) decrypt(ctx context.Context, request *DecryptRequest) (*DecryptResponse, error) {
+	keyResourceName := g.key.Load().uri
 	if request.KeyId != "" { // request.KeyId is empty when health checker calls this method from PingKMS()
 		keyResourceName = extractKeyName(request.KeyId)
 	}
-	resp, err := g.keyService.Decrypt(keyResourceName, &cloudkms.DecryptRequest{
-		Ciphertext: base64.StdEncoding.EncodeToString(request.Ciphertext),
-	}).Context(ctx).Do()
+
+	aad, err := g.decryptAAD(request.Annotations)
 	if err != nil {
-		plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("decrypt").Inc()
 		return nil, err
 	}
 
-	plain, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	// Payloads encrypted locally are decrypted regardless of the current mode so that
+	// local encryption can be turned off without re-encrypting the data.
+	if wrapped, ok := request.Annotations[encryptedDEKAnnotationKey]; ok {
+		return g.decryptLocally(ctx, keyResourceName, wrapped, request.Ciphertext, aad, request.Annotations)
+	}
+
+	plain, err := g.decryptWithReplicas(ctx, keyResourceName, request.Ciphertext, aad, request.Annotations)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode from base64, error: %w", err)
+		return nil, err
 	}
 
 	return &DecryptResponse{
@@ -159,6 +385,98 @@ func (g *Plugin) Decrypt(ctx context.Context, request *DecryptRequest) (*Decrypt
 	}, nil
 }
 
+// decryptWithFallback decrypts ciphertext with Cloud KMS using keyResourceName and, should that
+// fail, with the configured key URI and each of the decrypt key URIs in order.
+// The error of the first attempt is returned when none of the keys can decrypt the ciphertext.
+func (g *Plugin) decryptWithFallback(ctx context.Context, keyResourceName string, ciphertext, aad []byte) ([]byte, error) {
+	defer plugin.RecordCloudKMSOperation("decrypt", time.Now().UTC())
+
+	var firstErr error
+	for _, name := range g.decryptKeyNames(keyResourceName) {
+		resp, err := plugin.Call(ctx, "decrypt", g.backoff, g.breaker, g.keyService.Decrypt(name, plugin.NewDecryptRequest(ciphertext, aad)).Context(ctx).Do)
+		if err != nil {
+			// A corrupted request must not be retried with other keys either.
+			if err = plugin.ConvertChecksumRejection("decrypt", err); plugin.IsIntegrityError(err) {
+				plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("decrypt").Inc()
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			glog.V(4).Infof("Failed to decrypt using %s, error: %v", name, err)
+			// Another key cannot help while Cloud KMS is unavailable, it would only multiply the calls.
+			if !plugin.IsKeyError(err) {
+				break
+			}
+			continue
+		}
+
+		plain, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode from base64, error: %w", err)
+		}
+
+		// A corrupted plaintext must not be retried with other keys.
+		if err := plugin.VerifyDecryptResponse(resp, plain); err != nil {
+			return nil, err
+		}
+		if name != keyResourceName {
+			glog.V(4).Infof("Decrypted using fallback key %s", name)
+		}
+		return plain, nil
+	}
+
+	plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("decrypt").Inc()
+	if firstErr == nil {
+		firstErr = errors.New("no Cloud KMS key to decrypt with")
+	}
+	return nil, firstErr
+}
+
+// annotations records the additional authenticated data the payload was encrypted with and
+// the replicas of the payload, if any.
+func (g *Plugin) annotations(replicas []byte) map[string][]byte {
+	annotations := make(map[string][]byte)
+	if len(g.aad) != 0 {
+		annotations[aadAnnotationKey] = g.aad
+	}
+	if replicas != nil {
+		annotations[replicasAnnotationKey] = replicas
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+	return annotations
+}
+
+// decryptAAD returns the additional authenticated data to decrypt a payload with the given annotations.
+// Payloads encrypted before the AAD was configured do not carry the annotation and are decrypted without it,
+// while payloads bound to a different AAD are rejected without calling Cloud KMS.
+func (g *Plugin) decryptAAD(annotations map[string][]byte) ([]byte, error) {
+	aad, ok := annotations[aadAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	if !bytes.Equal(aad, g.aad) {
+		return nil, fmt.Errorf("%w: payload is bound to %q, the plugin is configured with %q", plugin.ErrAADMismatch, aad, g.aad)
+	}
+	return aad, nil
+}
+
+// decryptKeyNames lists the keys to attempt decryption with, starting with keyResourceName.
+func (g *Plugin) decryptKeyNames(keyResourceName string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range append([]string{keyResourceName, g.key.Load().uri}, g.decryptKeyURIs...) {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
 // keyID is a threadsafe way to get the current key ID.
 func (g *Plugin) keyID() string {
 	g.lastKeyIDLock.RLock()
@@ -173,18 +491,51 @@ func (g *Plugin) keyID() string {
 // This is to return a unique key id to Kubernetes in case if the plugin is
 // reconfigured to use a Cloud KMS key version which has been already in use
 // before
-func (g *Plugin) setKeyID(name string) string {
+//
+// The key ID is only recorded if key is still current, so that a request in progress during SetKey
+// does not bring back the key ID of the previous key.
+func (g *Plugin) setKeyID(key *keySettings, name string) string {
 	result := name
-	if v := g.keySuffix; v != "" {
+	if v := key.suffix; v != "" {
 		result = result + ":" + v
 	}
 
 	g.lastKeyIDLock.Lock()
 	defer g.lastKeyIDLock.Unlock()
+	if g.key.Load() != key {
+		return result
+	}
+	if g.lastKeyID != result && g.decryptCache != nil {
+		g.decryptCache.RemoveAll(func(any) bool { return true })
+	}
 	g.lastKeyID = result
 	return result
 }
 
+// decryptCacheKey hashes KeyId and Ciphertext so that the cache does not hold on to ciphertexts.
+func decryptCacheKey(request *DecryptRequest) string {
+	h := sha256.New()
+	h.Write([]byte(request.KeyId))
+	h.Write([]byte{0})
+	h.Write(request.Ciphertext)
+	return string(h.Sum(nil))
+}
+
+// decryptFlightKey hashes KeyId, Ciphertext and Annotations, all of which determine the outcome of a decryption.
+func decryptFlightKey(request *DecryptRequest) string {
+	h := sha256.New()
+	h.Write([]byte(request.KeyId))
+	h.Write([]byte{0})
+	h.Write(request.Ciphertext)
+	for _, k := range slices.Sorted(maps.Keys(request.Annotations)) {
+		h.Write([]byte{0})
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write(request.Annotations[k])
+	}
+	return string(h.Sum(nil))
+}
+
 // Extracts the Cloud KMS key resource name from the key version resource name
 func extractKeyName(keyVersionId string) string {
 	return keyResourceRegEx.FindString(keyVersionId)
@@ -16,15 +16,22 @@ package v2
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -32,6 +39,9 @@ import (
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
 	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/plugin"
 	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/testutils/fakekms"
@@ -55,15 +65,21 @@ const (
 )
 
 var (
+	plaintextCRC32C  = plugin.CRC32C([]byte("foo"))
+	ciphertextCRC32C = plugin.CRC32C([]byte("bar"))
+
 	positiveEncryptResponse = &cloudkms.EncryptResponse{
-		Ciphertext: ciphertext,
-		Name:       keyName,
+		Ciphertext:              ciphertext,
+		CiphertextCrc32c:        ciphertextCRC32C,
+		VerifiedPlaintextCrc32c: true,
+		Name:                    keyName,
 		ServerResponse: googleapi.ServerResponse{
 			HTTPStatusCode: http.StatusOK,
 		},
 	}
 	positiveDecryptResponse = &cloudkms.DecryptResponse{
-		Plaintext: plaintext,
+		Plaintext:       plaintext,
+		PlaintextCrc32c: plaintextCRC32C,
 		ServerResponse: googleapi.ServerResponse{
 			HTTPStatusCode: http.StatusOK,
 		},
@@ -87,7 +103,7 @@ func (p *pluginTestCase) tearDown() {
 	p.fakeKMSSrv.Close()
 }
 
-func setUp(t *testing.T, fakeKMSSrv *fakekms.Server, keyName string, keySuffix string) *pluginTestCase {
+func setUp(t *testing.T, fakeKMSSrv *fakekms.Server, keyName string, keySuffix string, opts ...Option) *pluginTestCase {
 	t.Helper()
 
 	dir, err := os.MkdirTemp(os.TempDir(), "")
@@ -109,7 +125,7 @@ func setUp(t *testing.T, fakeKMSSrv *fakekms.Server, keyName string, keySuffix s
 		t.Fatalf("failed to instantiate cloud kms httpClient: %v", err)
 	}
 	fakeKMSKeyService.BasePath = fakeKMSSrv.URL()
-	p := NewPlugin(fakeKMSKeyService.Projects.Locations.KeyRings.CryptoKeys, keyName, keySuffix)
+	p := NewPlugin(fakeKMSKeyService.Projects.Locations.KeyRings.CryptoKeys, keyName, keySuffix, opts...)
 	pluginManager := plugin.NewManager(p, socket)
 	pluginRPCSrv, errCh := pluginManager.Start()
 	// Giving some time for plugin to start while listening on the error channel.
@@ -137,6 +153,7 @@ func setUpWithResponses(t *testing.T, keyName string, keySuffix string, delay ti
 }
 
 func TestMain(m *testing.M) {
+	plugin.RegisterLegacyMetrics()
 	os.Exit(m.Run())
 }
 
@@ -153,7 +170,7 @@ func TestEncrypt(t *testing.T) {
 	}{
 		{
 			desc:                "Encrypt",
-			wantEncryptRequests: []*cloudkms.EncryptRequest{{Plaintext: plaintext}},
+			wantEncryptRequests: []*cloudkms.EncryptRequest{{Plaintext: plaintext, PlaintextCrc32c: plaintextCRC32C}},
 			testFn: func(t *testing.T, p *Plugin) {
 				encryptRequest := EncryptRequest{Plaintext: []byte("foo")}
 				if _, err := p.Encrypt(context.Background(), &encryptRequest); err != nil {
@@ -164,7 +181,7 @@ func TestEncrypt(t *testing.T) {
 		},
 		{
 			desc:                "Decrypt",
-			wantDecryptRequests: []*cloudkms.DecryptRequest{{Ciphertext: ciphertext}},
+			wantDecryptRequests: []*cloudkms.DecryptRequest{{Ciphertext: ciphertext, CiphertextCrc32c: ciphertextCRC32C}},
 			testFn: func(t *testing.T, p *Plugin) {
 				decryptRequest := DecryptRequest{Ciphertext: []byte("bar"), KeyId: keyVersionName}
 				if _, err := p.Decrypt(context.Background(), &decryptRequest); err != nil {
@@ -175,7 +192,7 @@ func TestEncrypt(t *testing.T) {
 		},
 		{
 			desc:                "Encrypt",
-			wantEncryptRequests: []*cloudkms.EncryptRequest{{Plaintext: plaintext}},
+			wantEncryptRequests: []*cloudkms.EncryptRequest{{Plaintext: plaintext, PlaintextCrc32c: plaintextCRC32C}},
 			testFn: func(t *testing.T, p *Plugin) {
 				encryptRequest := EncryptRequest{Plaintext: []byte("foo")}
 				if _, err := p.Encrypt(context.Background(), &encryptRequest); err != nil {
@@ -187,7 +204,7 @@ func TestEncrypt(t *testing.T) {
 		},
 		{
 			desc:                "Decrypt",
-			wantDecryptRequests: []*cloudkms.DecryptRequest{{Ciphertext: ciphertext}},
+			wantDecryptRequests: []*cloudkms.DecryptRequest{{Ciphertext: ciphertext, CiphertextCrc32c: ciphertextCRC32C}},
 			testFn: func(t *testing.T, p *Plugin) {
 				decryptRequest := DecryptRequest{Ciphertext: []byte("bar"), KeyId: keyVersionName}
 				if _, err := p.Decrypt(context.Background(), &decryptRequest); err != nil {
@@ -242,6 +259,7 @@ func TestGatherMetrics(t *testing.T) {
 				}
 			},
 			want: []string{
+				"cloudkms_plugin_cloudkms_request_duration_seconds",
 				"roundtrip_latencies",
 			},
 			response: positiveDecryptResponse,
@@ -256,6 +274,7 @@ func TestGatherMetrics(t *testing.T) {
 				}
 			},
 			want: []string{
+				"cloudkms_plugin_cloudkms_request_duration_seconds",
 				"roundtrip_latencies",
 				"failures_count",
 			},
@@ -275,6 +294,7 @@ func TestGatherMetrics(t *testing.T) {
 				}
 			},
 			want: []string{
+				"cloudkms_plugin_cloudkms_request_duration_seconds",
 				"roundtrip_latencies",
 			},
 			response: positiveEncryptResponse,
@@ -289,6 +309,7 @@ func TestGatherMetrics(t *testing.T) {
 				}
 			},
 			want: []string{
+				"cloudkms_plugin_cloudkms_request_duration_seconds",
 				"roundtrip_latencies",
 				"failures_count",
 			},
@@ -374,6 +395,455 @@ func TestKMSTimeout(t *testing.T) {
 	}
 }
 
+func TestAdditionalAuthenticatedData(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	aad := []byte("cluster-uid")
+	aadEncryptResponse := *positiveEncryptResponse
+	aadEncryptResponse.VerifiedAdditionalAuthenticatedDataCrc32c = true
+	tt := setUpWithResponses(t, keyName, keySuffix, 0, &aadEncryptResponse, positiveDecryptResponse)
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+	p := NewPlugin(tt.plugin.keyService, keyName, keySuffix, WithAdditionalAuthenticatedData(aad))
+
+	encryptResponse, err := p.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("foo")})
+	if err != nil {
+		t.Fatalf("Failed to encrypt, error: %v", err)
+	}
+	if got := string(encryptResponse.Annotations[aadAnnotationKey]); got != string(aad) {
+		t.Fatalf("Got %q in %s annotation, want %q", got, aadAnnotationKey, aad)
+	}
+
+	// A payload bound to another cluster is rejected before reaching Cloud KMS.
+	if _, err := p.Decrypt(ctx, &DecryptRequest{
+		Ciphertext:  []byte("bar"),
+		KeyId:       keyVersionName,
+		Annotations: map[string][]byte{aadAnnotationKey: []byte("other-cluster-uid")},
+	}); status.Code(plugin.StatusError(err)) != codes.FailedPrecondition {
+		t.Fatalf("Got %v for a payload bound to another AAD, want %v", err, codes.FailedPrecondition)
+	}
+
+	if _, err := p.Decrypt(ctx, &DecryptRequest{
+		Ciphertext:  []byte("bar"),
+		KeyId:       keyVersionName,
+		Annotations: encryptResponse.Annotations,
+	}); err != nil {
+		t.Fatalf("Failed to decrypt, error: %v", err)
+	}
+
+	if err := tt.fakeKMSSrv.EncryptRequestsEqual([]*cloudkms.EncryptRequest{{
+		Plaintext:                         plaintext,
+		PlaintextCrc32c:                   plaintextCRC32C,
+		AdditionalAuthenticatedData:       base64.StdEncoding.EncodeToString(aad),
+		AdditionalAuthenticatedDataCrc32c: plugin.CRC32C(aad),
+	}}); err != nil {
+		t.Fatalf("Failed to compare last processed request on KMS Server, error: %v", err)
+	}
+	if err := tt.fakeKMSSrv.DecryptRequestsEqual([]*cloudkms.DecryptRequest{{
+		Ciphertext:                        ciphertext,
+		CiphertextCrc32c:                  ciphertextCRC32C,
+		AdditionalAuthenticatedData:       base64.StdEncoding.EncodeToString(aad),
+		AdditionalAuthenticatedDataCrc32c: plugin.CRC32C(aad),
+	}}); err != nil {
+		t.Fatalf("Failed to compare last processed request on KMS Server, error: %v", err)
+	}
+}
+
+func TestDecryptFallback(t *testing.T) {
+	t.Parallel()
+
+	tt := setUpWithResponses(t, keyName, keySuffix, 0, positiveDecryptResponse)
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	// FakeKMS does not serve newKeyName, so decryption has to fall back to keyName.
+	newKeyName := "projects/my-project/locations/us-east1/keyRings/new-key-ring/cryptoKeys/my-key"
+	p := NewPlugin(tt.plugin.keyService, newKeyName, keySuffix, WithDecryptKeyURIs(keyName))
+	resp, err := p.Decrypt(context.Background(), &DecryptRequest{Ciphertext: []byte("bar"), KeyId: newKeyName + "/cryptoKeyVersions/1"})
+	if err != nil {
+		t.Fatalf("Failed to decrypt with the fallback key, error: %v", err)
+	}
+	if string(resp.Plaintext) != "foo" {
+		t.Fatalf("Got %q after decryption, want %q", resp.Plaintext, "foo")
+	}
+	if err := tt.fakeKMSSrv.DecryptRequestsEqual([]*cloudkms.DecryptRequest{{Ciphertext: ciphertext, CiphertextCrc32c: ciphertextCRC32C}}); err != nil {
+		t.Fatalf("Failed to compare last processed request on KMS Server, error: %v", err)
+	}
+}
+
+func TestDecryptFallbackOnlyForKeyErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		desc         string
+		status       int
+		wantRequests int32
+	}{
+		{desc: "Ciphertext of another key falls back", status: http.StatusBadRequest, wantRequests: 2},
+		{desc: "Cloud KMS unavailable does not fall back", status: http.StatusServiceUnavailable, wantRequests: 1},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var decryptRequests atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				decryptRequests.Add(1)
+				http.Error(w, http.StatusText(testCase.status), testCase.status)
+			}))
+			t.Cleanup(srv.Close)
+
+			keyService, err := cloudkms.NewService(context.Background(), option.WithHTTPClient(srv.Client()))
+			if err != nil {
+				t.Fatalf("failed to instantiate cloud kms httpClient: %v", err)
+			}
+			keyService.BasePath = srv.URL
+			p := NewPlugin(keyService.Projects.Locations.KeyRings.CryptoKeys, keyName, "",
+				WithDecryptKeyURIs(keyName+"-old"), WithBackoff(plugin.Backoff{Attempts: 1}))
+
+			if _, err := p.Decrypt(context.Background(), &DecryptRequest{Ciphertext: []byte("bar"), KeyId: keyVersionName}); err == nil {
+				t.Fatal("Expected Decrypt to fail")
+			}
+			if got := decryptRequests.Load(); got != testCase.wantRequests {
+				t.Fatalf("Got %d decrypt requests to Cloud KMS, want %d", got, testCase.wantRequests)
+			}
+		})
+	}
+}
+
+func TestCoalescedDecrypt(t *testing.T) {
+	t.Parallel()
+
+	// FakeKMS serves a single response, the plugin must not call it again for identical requests.
+	tt := setUpWithResponses(t, keyName, keySuffix, 500*time.Millisecond, positiveDecryptResponse)
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := tt.plugin.Decrypt(context.Background(), &DecryptRequest{Ciphertext: []byte("bar"), KeyId: keyVersionName})
+			if err == nil && string(resp.Plaintext) != "foo" {
+				err = fmt.Errorf("got %q after decryption, want %q", resp.Plaintext, "foo")
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Failed to decrypt, error: %v", err)
+		}
+	}
+	if got := tt.fakeKMSSrv.DecryptRequestsCount(); got != 1 {
+		t.Fatalf("Got %d decrypt requests to Cloud KMS, want 1", got)
+	}
+}
+
+func TestDecryptCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyName, 0, 0, positiveDecryptResponse)
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	tt := setUp(t, fakeKMSSrv, keyName, keySuffix, WithDecryptCache(10, time.Hour))
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	decryptRequest := DecryptRequest{Ciphertext: []byte("bar"), KeyId: keyVersionName}
+	for i := 0; i < 2; i++ {
+		resp, err := tt.plugin.Decrypt(ctx, &decryptRequest)
+		if err != nil {
+			t.Fatalf("Failure while submitting request %v, error %v", decryptRequest, err)
+		}
+		if string(resp.Plaintext) != "foo" {
+			t.Fatalf("Got %q after decryption, want %q", resp.Plaintext, "foo")
+		}
+	}
+	if err := tt.fakeKMSSrv.DecryptRequestsEqual([]*cloudkms.DecryptRequest{{Ciphertext: ciphertext, CiphertextCrc32c: ciphertextCRC32C}}); err != nil {
+		t.Fatalf("Expected the second decrypt to be served from the cache, error: %v", err)
+	}
+
+	// The cache is dropped once the key ID changes, FakeKMS has no more responses.
+	tt.plugin.setKeyID(tt.plugin.key.Load(), keyName+"/cryptoKeyVersions/2")
+	if _, err := tt.plugin.Decrypt(ctx, &decryptRequest); err == nil {
+		t.Fatal("Expected decrypt to reach FakeKMS after the key ID change")
+	}
+
+	got, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %s", err)
+	}
+	checkForExpectedMetrics(t, got, []string{"cloudkms_plugin_decrypt_cache_hits_count", "decrypt_cache_hits_count", "decrypt_cache_misses_count"})
+}
+
+func TestDecryptCacheAdditionalAuthenticatedData(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	aad := []byte("cluster-uid")
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyName, 0, 0, positiveDecryptResponse)
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	tt := setUp(t, fakeKMSSrv, keyName, keySuffix, WithDecryptCache(10, time.Hour), WithAdditionalAuthenticatedData(aad))
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	decryptRequest := DecryptRequest{
+		Ciphertext:  []byte("bar"),
+		KeyId:       keyVersionName,
+		Annotations: map[string][]byte{aadAnnotationKey: aad},
+	}
+	if _, err := tt.plugin.Decrypt(ctx, &decryptRequest); err != nil {
+		t.Fatalf("Failure while submitting request %v, error %v", decryptRequest, err)
+	}
+
+	// The same ciphertext bound to another cluster must not be served from the cache.
+	decryptRequest.Annotations = map[string][]byte{aadAnnotationKey: []byte("other-cluster-uid")}
+	if _, err := tt.plugin.Decrypt(ctx, &decryptRequest); err == nil {
+		t.Fatal("Expected decrypt of a cached payload bound to another AAD to fail")
+	}
+}
+
+// corruptingTransport flips a bit of the ciphertext of decrypt requests after their checksum is computed.
+type corruptingTransport struct {
+	decryptRequests atomic.Int32
+}
+
+func (c *corruptingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(r.URL.Path, ":decrypt") {
+		return http.DefaultTransport.RoundTrip(r)
+	}
+	c.decryptRequests.Add(1)
+	d := &cloudkms.DecryptRequest{}
+	if err := json.NewDecoder(r.Body).Decode(d); err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(d.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext[0] ^= 1
+	d.Ciphertext = base64.StdEncoding.EncodeToString(ciphertext)
+	body, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	r = r.Clone(r.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestChecksumRejection(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	aad := []byte("cluster-uid")
+	tt := setUpWithPipethrough(t, WithAdditionalAuthenticatedData(aad))
+	encryptResponse, err := tt.plugin.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("foo")})
+	if err != nil {
+		t.Fatalf("Failed to encrypt, error: %v", err)
+	}
+
+	transport := &corruptingTransport{}
+	keyService, err := cloudkms.NewService(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatalf("failed to instantiate cloud kms httpClient: %v", err)
+	}
+	keyService.BasePath = tt.fakeKMSSrv.URL()
+	p := NewPlugin(keyService.Projects.Locations.KeyRings.CryptoKeys, keyName, "",
+		WithAdditionalAuthenticatedData(aad), WithDecryptKeyURIs(keyName+"-old"))
+
+	_, err = p.Decrypt(ctx, &DecryptRequest{
+		Ciphertext:  encryptResponse.Ciphertext,
+		KeyId:       encryptResponse.KeyId,
+		Annotations: encryptResponse.Annotations,
+	})
+	if !plugin.IsIntegrityError(err) {
+		t.Fatalf("Got %v, want an integrity error", err)
+	}
+	// The corrupted request is not retried with the fallback key.
+	if got := transport.decryptRequests.Load(); got != 1 {
+		t.Fatalf("Got %d decrypt requests to Cloud KMS, want 1", got)
+	}
+}
+
+func TestEncryptRetry(t *testing.T) {
+	t.Parallel()
+
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyName, 0, 0, negativeEncryptResponse, positiveEncryptResponse)
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	tt := setUp(t, fakeKMSSrv, keyName, keySuffix, WithBackoff(plugin.Backoff{Attempts: 2, Initial: time.Millisecond, Max: time.Millisecond}))
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	if _, err := tt.plugin.Encrypt(context.Background(), &EncryptRequest{Plaintext: []byte("foo")}); err != nil {
+		t.Fatalf("Failed to encrypt after a retry, error: %v", err)
+	}
+	if got := tt.fakeKMSSrv.EncryptRequestsCount(); got != 2 {
+		t.Fatalf("Got %d encrypt requests to Cloud KMS, want 2", got)
+	}
+
+	got, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %s", err)
+	}
+	checkForExpectedMetrics(t, got, []string{"retries_count"})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyName, 0, 0, negativeEncryptResponse)
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	tt := setUp(t, fakeKMSSrv, keyName, keySuffix, WithCircuitBreaker(plugin.NewCircuitBreaker(1, time.Hour)))
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	ctx := context.Background()
+	if _, err := tt.plugin.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("foo")}); err == nil {
+		t.Fatal("Expected encrypt to fail while Cloud KMS is unavailable")
+	}
+	if _, err := tt.plugin.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("foo")}); !plugin.IsCircuitOpen(err) {
+		t.Fatalf("Got %v, want encrypt to fail fast", err)
+	}
+
+	resp, err := tt.plugin.Status(ctx, &StatusRequest{})
+	if err != nil {
+		t.Fatalf("Status failed, error: %v", err)
+	}
+	if resp.Healthz != circuitOpen {
+		t.Fatalf("Got Healthz %q, want %q", resp.Healthz, circuitOpen)
+	}
+	if got := tt.fakeKMSSrv.EncryptRequestsCount(); got != 1 {
+		t.Fatalf("Got %d encrypt requests to Cloud KMS, want 1", got)
+	}
+}
+
+func TestStatusKeyDisabled(t *testing.T) {
+	t.Parallel()
+
+	tt := setUpWithResponses(t, keyName, "", 0, &fakekms.ErrorResponse{
+		Code:    http.StatusBadRequest,
+		Status:  "FAILED_PRECONDITION",
+		Message: keyVersionName + " is not enabled, current state is: DISABLED.",
+	})
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	resp, err := tt.plugin.Status(context.Background(), &StatusRequest{})
+	if err != nil {
+		t.Fatalf("Status failed, error: %v", err)
+	}
+	if resp.Healthz != keyDisabled {
+		t.Fatalf("Got Healthz %q, want %q", resp.Healthz, keyDisabled)
+	}
+}
+
+func TestSetKey(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		desc string
+		opts []Option
+	}{
+		{
+			desc: "Remote encryption",
+		},
+		{
+			desc: "Local encryption",
+			opts: []Option{WithLocalEncryption(time.Hour)},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			tt := setUpWithPipethrough(t, testCase.opts...)
+			before, err := tt.plugin.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("foo")})
+			if err != nil {
+				t.Fatalf("Failed to encrypt, error: %v", err)
+			}
+			previousKey := tt.plugin.key.Load()
+
+			tt.plugin.SetKey(keyName, "rotated")
+			after, err := tt.plugin.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("foo")})
+			if err != nil {
+				t.Fatalf("Failed to encrypt after SetKey, error: %v", err)
+			}
+			if want := before.KeyId + ":rotated"; after.KeyId != want {
+				t.Fatalf("Got KeyId %q after SetKey, want %q", after.KeyId, want)
+			}
+
+			// A request that started before SetKey does not bring back the previous key ID.
+			tt.plugin.setKeyID(previousKey, keyVersionName)
+			if got := tt.plugin.keyID(); got != after.KeyId {
+				t.Fatalf("Got key ID %q, want %q", got, after.KeyId)
+			}
+
+			resp, err := tt.plugin.Decrypt(ctx, &DecryptRequest{Ciphertext: before.Ciphertext, KeyId: before.KeyId, Annotations: before.Annotations})
+			if err != nil {
+				t.Fatalf("Failed to decrypt a payload encrypted before SetKey, error: %v", err)
+			}
+			if !bytes.Equal(resp.Plaintext, []byte("foo")) {
+				t.Fatalf("Got %q after decryption, want %q", resp.Plaintext, "foo")
+			}
+		})
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	t.Parallel()
+
+	forbiddenEncryptResponse := &cloudkms.EncryptResponse{
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: http.StatusForbidden,
+		},
+	}
+	tt := setUpWithResponses(t, keyName, keySuffix, 0, forbiddenEncryptResponse)
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	conn, err := grpc.NewClient("unix:"+tt.socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to connect to the plugin, error: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	_, err = NewKeyManagementServiceClient(conn).Encrypt(context.Background(), &EncryptRequest{Plaintext: []byte("foo")})
+	if got := status.Code(err); got != codes.PermissionDenied {
+		t.Fatalf("Got %v, want %v", err, codes.PermissionDenied)
+	}
+}
+
 func TestMetricsServer(t *testing.T) {
 	t.Parallel()
 
@@ -394,7 +864,7 @@ func TestMetricsServer(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to scrape metrics, %v", err)
 	}
-	checkForExpectedMetrics(t, m, []string{"roundtrip_latencies"})
+	checkForExpectedMetrics(t, m, []string{"cloudkms_plugin_cloudkms_request_duration_seconds", "roundtrip_latencies"})
 }
 
 func mustServeMetrics(t *testing.T) int {
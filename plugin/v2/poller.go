@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/plugin"
+)
+
+// PollKeyVersion periodically reads the primary version of the key with CryptoKeys.Get and updates the
+// key ID and health reported by Status, until ctx is done.
+// It returns immediately unless the plugin was constructed WithKeyVersionPolling.
+func (g *Plugin) PollKeyVersion(ctx context.Context) {
+	if g.keyPollInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(g.keyPollInterval)
+	defer ticker.Stop()
+
+	for {
+		g.pollKeyVersion(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *Plugin) pollKeyVersion(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, g.keyPollTimeout)
+	defer cancel()
+
+	key := g.key.Load()
+	primary, err := g.primaryKeyVersion(ctx, key.uri)
+	if err != nil {
+		glog.Warningf("Failed to get the primary version of %s, error: %v", key.uri, err)
+		if status.Code(plugin.StatusError(err)) == codes.PermissionDenied {
+			g.setHealthz(keyDisabled)
+			return
+		}
+		g.setHealthz(keyNotReachable)
+		return
+	}
+	if primary.State != "ENABLED" {
+		glog.Warningf("Primary version %s of %s is %s", primary.Name, key.uri, primary.State)
+		g.setHealthz(keyDisabled)
+		return
+	}
+
+	keyID := g.setKeyID(key, primary.Name)
+	g.setHealthz(ok)
+	glog.V(4).Infof("Primary key version of %s is %s", key.uri, keyID)
+}
+
+func (g *Plugin) primaryKeyVersion(ctx context.Context, keyURI string) (*cloudkms.CryptoKeyVersion, error) {
+	defer plugin.RecordCloudKMSOperation("get", time.Now().UTC())
+
+	key, err := plugin.Call(ctx, "get", g.backoff, g.breaker, g.keyService.Get(keyURI).Context(ctx).Do)
+	if err != nil {
+		plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("get").Inc()
+		return nil, err
+	}
+	if key.Primary == nil {
+		return nil, fmt.Errorf("key %s does not have a primary version", keyURI)
+	}
+
+	return key.Primary, nil
+}
+
+// healthz is a threadsafe way to get the health of the key as last observed by the poller.
+func (g *Plugin) healthz() string {
+	g.lastKeyIDLock.RLock()
+	defer g.lastKeyIDLock.RUnlock()
+	return g.lastHealthz
+}
+
+func (g *Plugin) setHealthz(healthz string) {
+	g.lastKeyIDLock.Lock()
+	defer g.lastKeyIDLock.Unlock()
+	g.lastHealthz = healthz
+}
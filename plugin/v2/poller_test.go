@@ -0,0 +1,142 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/testutils/fakekms"
+)
+
+func TestStatusWithKeyVersionPolling(t *testing.T) {
+	t.Parallel()
+
+	positiveGetResponse := &cloudkms.CryptoKey{
+		Name: keyName,
+		Primary: &cloudkms.CryptoKeyVersion{
+			Name:  keyVersionName,
+			State: "ENABLED",
+		},
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: http.StatusOK,
+		},
+	}
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyName, 0, 0, positiveGetResponse)
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	tt := setUp(t, fakeKMSSrv, keyName, keySuffix, WithKeyVersionPolling(time.Hour, 5*time.Second))
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	ctx := context.Background()
+	testCases := []struct {
+		desc        string
+		wantKeyID   string
+		wantHealthz string
+	}{
+		{
+			desc:        "Primary version is read from Cloud KMS",
+			wantKeyID:   keyVersionName + ":" + keySuffix,
+			wantHealthz: ok,
+		},
+		{
+			desc:        "Last known primary version is kept when Cloud KMS is not reachable",
+			wantKeyID:   keyVersionName + ":" + keySuffix,
+			wantHealthz: keyNotReachable,
+		},
+	}
+
+	for _, testCase := range testCases {
+		tt.plugin.pollKeyVersion(ctx)
+
+		resp, err := tt.plugin.Status(ctx, &StatusRequest{})
+		if err != nil {
+			t.Fatalf("%s: Status failed, error: %v", testCase.desc, err)
+		}
+		if resp.KeyId != testCase.wantKeyID || resp.Healthz != testCase.wantHealthz {
+			t.Fatalf("%s: got KeyId %q and Healthz %q, want %q and %q", testCase.desc, resp.KeyId, resp.Healthz, testCase.wantKeyID, testCase.wantHealthz)
+		}
+	}
+
+	if got := tt.fakeKMSSrv.EncryptRequestsCount(); got != 0 {
+		t.Fatalf("Got %d encrypt requests to Cloud KMS, want none", got)
+	}
+}
+
+func TestKeyVersionPollingTimeout(t *testing.T) {
+	t.Parallel()
+
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyName, 0, 3*time.Second, &cloudkms.CryptoKey{})
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	tt := setUp(t, fakeKMSSrv, keyName, keySuffix, WithKeyVersionPolling(time.Hour, time.Second))
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	// A hung call is bounded by the timeout rather than by the poll interval.
+	start := time.Now()
+	tt.plugin.pollKeyVersion(context.Background())
+	if elapsed := time.Since(start); elapsed >= 3*time.Second {
+		t.Fatalf("Poll took %v, want it to time out after a second", elapsed)
+	}
+	if got := tt.plugin.healthz(); got != keyNotReachable {
+		t.Fatalf("Got Healthz %q, want %q", got, keyNotReachable)
+	}
+}
+
+func TestKeyVersionPollingKeyDisabled(t *testing.T) {
+	t.Parallel()
+
+	disabledGetResponse := &cloudkms.CryptoKey{
+		Name: keyName,
+		Primary: &cloudkms.CryptoKeyVersion{
+			Name:  keyVersionName,
+			State: "DISABLED",
+		},
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: http.StatusOK,
+		},
+	}
+	forbiddenGetResponse := &cloudkms.CryptoKey{
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: http.StatusForbidden,
+		},
+	}
+	fakeKMSSrv, err := fakekms.NewWithResponses(keyName, 0, 0, disabledGetResponse, forbiddenGetResponse)
+	if err != nil {
+		t.Fatalf("Failed to construct FakeKMS, error: %v", err)
+	}
+	tt := setUp(t, fakeKMSSrv, keyName, keySuffix, WithKeyVersionPolling(time.Hour, 5*time.Second))
+	t.Cleanup(func() {
+		tt.tearDown()
+	})
+
+	for _, desc := range []string{"Primary version is disabled", "No cloudkms.cryptoKeys.get permission"} {
+		tt.plugin.pollKeyVersion(context.Background())
+		if got := tt.plugin.healthz(); got != keyDisabled {
+			t.Fatalf("%s: got Healthz %q, want %q", desc, got, keyDisabled)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/GoogleCloudPlatform/k8s-cloudkms-plugin/plugin"
+)
+
+// replicasAnnotationKey is the EncryptResponse annotation carrying copies of the payload (or of the
+// data encryption key in local encryption mode) wrapped with each of the replica keys.
+const replicasAnnotationKey = "replicas.cloudkms.k8s.io"
+
+// replica is a copy of a payload wrapped with a replica key.
+type replica struct {
+	KeyName    string `json:"keyName"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// encryptWithKey encrypts plain with Cloud KMS using keyName and returns the name of the key version
+// used together with the ciphertext.
+func (g *Plugin) encryptWithKey(ctx context.Context, keyName string, plain []byte) (string, []byte, error) {
+	defer plugin.RecordCloudKMSOperation("encrypt", time.Now().UTC())
+
+	resp, err := plugin.Call(ctx, "encrypt", g.backoff, g.breaker, g.keyService.Encrypt(keyName, plugin.NewEncryptRequest(plain, g.aad)).Context(ctx).Do)
+	if err != nil {
+		plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("encrypt").Inc()
+		return "", nil, plugin.ConvertChecksumRejection("encrypt", err)
+	}
+
+	cipher, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := plugin.VerifyEncryptResponse(resp, cipher, g.aad); err != nil {
+		return "", nil, err
+	}
+
+	return resp.Name, cipher, nil
+}
+
+// wrapReplicas encrypts plain with every replica key concurrently and returns the encoded replicas
+// annotation, or nil when no replica keys are configured.
+// It fails unless at least minReplicas keys (all of them by default) wrapped the payload.
+func (g *Plugin) wrapReplicas(ctx context.Context, plain []byte) ([]byte, error) {
+	if len(g.replicaKeyURIs) == 0 {
+		return nil, nil
+	}
+
+	results := make([]*replica, len(g.replicaKeyURIs))
+	errs := make([]error, len(g.replicaKeyURIs))
+	var wg sync.WaitGroup
+	for i, name := range g.replicaKeyURIs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, cipher, err := g.encryptWithKey(ctx, name, plain)
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to encrypt with replica key %s, error: %w", name, err)
+				return
+			}
+			results[i] = &replica{KeyName: name, Ciphertext: cipher}
+		}()
+	}
+	wg.Wait()
+
+	var replicas []replica
+	for _, r := range results {
+		if r != nil {
+			replicas = append(replicas, *r)
+		}
+	}
+
+	err := errors.Join(errs...)
+	required := g.minReplicas
+	if required < 0 {
+		required = len(g.replicaKeyURIs)
+	}
+	if len(replicas) < required {
+		return nil, fmt.Errorf("wrapped the payload with %d of the required %d replica keys, error: %w", len(replicas), required, err)
+	}
+	if err != nil {
+		glog.Warningf("Payload is missing replicas, error: %v", err)
+	}
+	return json.Marshal(replicas)
+}
+
+// decryptReplicas decrypts the first of the replicas in the annotation that Cloud KMS can decrypt.
+// Replicas are only decrypted with configured keys, the annotation is stored in etcd and must not
+// be able to direct the plugin to an arbitrary key.
+func (g *Plugin) decryptReplicas(ctx context.Context, annotation, aad []byte) ([]byte, error) {
+	defer plugin.RecordCloudKMSOperation("decrypt", time.Now().UTC())
+
+	var replicas []replica
+	if err := json.Unmarshal(annotation, &replicas); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode %s annotation, error: %v", plugin.ErrInvalidCiphertext, replicasAnnotationKey, err)
+	}
+
+	var errs []error
+	for _, r := range replicas {
+		if !g.isConfiguredKey(r.KeyName) {
+			errs = append(errs, fmt.Errorf("replica key %s is not configured", r.KeyName))
+			continue
+		}
+
+		resp, err := plugin.Call(ctx, "decrypt", g.backoff, g.breaker, g.keyService.Decrypt(r.KeyName, plugin.NewDecryptRequest(r.Ciphertext, aad)).Context(ctx).Do)
+		if err != nil {
+			plugin.CloudKMSOperationalFailuresTotal.WithLabelValues("decrypt").Inc()
+			if err = plugin.ConvertChecksumRejection("decrypt", err); plugin.IsIntegrityError(err) {
+				return nil, err
+			}
+			errs = append(errs, fmt.Errorf("failed to decrypt with replica key %s, error: %w", r.KeyName, err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		plain, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode from base64, error: %w", err)
+		}
+		if err := plugin.VerifyDecryptResponse(resp, plain); err != nil {
+			return nil, err
+		}
+
+		glog.V(4).Infof("Decrypted using replica key %s", r.KeyName)
+		return plain, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, errors.New("no replica to decrypt")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// decryptWithReplicas decrypts ciphertext with the keys tried by decryptWithFallback and, should none
+// of them be reachable, with the replicas carried in annotations.
+// When there are replicas, the keys of decryptWithFallback are given half of the remaining deadline, so
+// that a location hanging until the deadline does not leave the replicas without time.
+func (g *Plugin) decryptWithReplicas(ctx context.Context, keyResourceName string, ciphertext, aad []byte, annotations map[string][]byte) ([]byte, error) {
+	annotation, ok := annotations[replicasAnnotationKey]
+	if !ok {
+		return g.decryptWithFallback(ctx, keyResourceName, ciphertext, aad)
+	}
+
+	primaryCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		primaryCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/2)
+		defer cancel()
+	}
+
+	plain, err := g.decryptWithFallback(primaryCtx, keyResourceName, ciphertext, aad)
+	if err == nil || plugin.IsIntegrityError(err) || ctx.Err() != nil {
+		return plain, err
+	}
+	glog.Warningf("Failed to decrypt using %s, falling back to replica keys, error: %v", keyResourceName, err)
+
+	plain, replicaErr := g.decryptReplicas(ctx, annotation, aad)
+	if replicaErr != nil {
+		return nil, errors.Join(err, replicaErr)
+	}
+	return plain, nil
+}
+
+// isConfiguredKey reports whether name is the key, one of the decrypt keys or one of the replica keys
+// the plugin is configured with.
+func (g *Plugin) isConfiguredKey(name string) bool {
+	return name == g.key.Load().uri || slices.Contains(g.decryptKeyURIs, name) || slices.Contains(g.replicaKeyURIs, name)
+}
@@ -0,0 +1,157 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// FakeKMS does not serve unreachableKeyName, standing in for a key in a location that is down.
+const unreachableKeyName = "projects/my-project/locations/us-west1/keyRings/my-key-ring/cryptoKeys/my-key"
+
+// hangingTransport blocks requests for unreachableKeyName until they are cancelled, like a location
+// that does not respond at all.
+type hangingTransport struct{}
+
+func (hangingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if strings.Contains(r.URL.Path, unreachableKeyName) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestReplicas(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		desc             string
+		opts             []Option
+		wantEncryptCount int
+	}{
+		{
+			desc:             "Remote encryption",
+			wantEncryptCount: 2,
+		},
+		{
+			desc:             "Local encryption",
+			opts:             []Option{WithLocalEncryption(time.Hour)},
+			wantEncryptCount: 2,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			tt := setUpWithPipethrough(t, append(testCase.opts, WithReplicaKeyURIs(keyName))...)
+
+			encryptResponse, err := tt.plugin.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("foo")})
+			if err != nil {
+				t.Fatalf("Failed to encrypt, error: %v", err)
+			}
+			if _, ok := encryptResponse.Annotations[replicasAnnotationKey]; !ok {
+				t.Fatalf("Expected %q annotation in the response, got %v", replicasAnnotationKey, encryptResponse.Annotations)
+			}
+			if got := tt.fakeKMSSrv.EncryptRequestsCount(); got != testCase.wantEncryptCount {
+				t.Fatalf("Got %d encrypt requests to Cloud KMS, want %d", got, testCase.wantEncryptCount)
+			}
+
+			// The payload was encrypted with unreachableKeyName as far as the plugins below can tell.
+			decryptRequest := &DecryptRequest{
+				Ciphertext:  encryptResponse.Ciphertext,
+				KeyId:       unreachableKeyName + "/cryptoKeyVersions/1",
+				Annotations: encryptResponse.Annotations,
+			}
+			p := NewPlugin(tt.plugin.keyService, unreachableKeyName, "", WithReplicaKeyURIs(keyName))
+			resp, err := p.Decrypt(ctx, decryptRequest)
+			if err != nil {
+				t.Fatalf("Failed to decrypt with the replica key, error: %v", err)
+			}
+			if !bytes.Equal(resp.Plaintext, []byte("foo")) {
+				t.Fatalf("Got %q after decryption, want %q", resp.Plaintext, "foo")
+			}
+
+			// Fresh plugins, the DEK of the local encryption is cached by p.
+			unconfigured := NewPlugin(tt.plugin.keyService, unreachableKeyName, "")
+			if _, err := unconfigured.Decrypt(ctx, decryptRequest); err == nil {
+				t.Fatal("Expected decrypt with a replica key that is not configured to fail")
+			}
+
+			delete(decryptRequest.Annotations, replicasAnnotationKey)
+			p = NewPlugin(tt.plugin.keyService, unreachableKeyName, "", WithReplicaKeyURIs(keyName))
+			if _, err := p.Decrypt(ctx, decryptRequest); err == nil {
+				t.Fatal("Expected decrypt without replicas to fail")
+			}
+		})
+	}
+}
+
+func TestReplicasPrimaryTimeout(t *testing.T) {
+	t.Parallel()
+
+	tt := setUpWithPipethrough(t, WithReplicaKeyURIs(keyName))
+	encryptResponse, err := tt.plugin.Encrypt(context.Background(), &EncryptRequest{Plaintext: []byte("foo")})
+	if err != nil {
+		t.Fatalf("Failed to encrypt, error: %v", err)
+	}
+
+	keyService, err := cloudkms.NewService(context.Background(), option.WithHTTPClient(&http.Client{Transport: hangingTransport{}}))
+	if err != nil {
+		t.Fatalf("failed to instantiate cloud kms httpClient: %v", err)
+	}
+	keyService.BasePath = tt.fakeKMSSrv.URL()
+	p := NewPlugin(keyService.Projects.Locations.KeyRings.CryptoKeys, unreachableKeyName, "", WithReplicaKeyURIs(keyName))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, err := p.Decrypt(ctx, &DecryptRequest{
+		Ciphertext:  encryptResponse.Ciphertext,
+		KeyId:       unreachableKeyName + "/cryptoKeyVersions/1",
+		Annotations: encryptResponse.Annotations,
+	})
+	if err != nil {
+		t.Fatalf("Failed to decrypt with the replica key while the primary key hangs, error: %v", err)
+	}
+	if !bytes.Equal(resp.Plaintext, []byte("foo")) {
+		t.Fatalf("Got %q after decryption, want %q", resp.Plaintext, "foo")
+	}
+}
+
+func TestMinReplicaCopies(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tt := setUpWithPipethrough(t)
+
+	p := NewPlugin(tt.plugin.keyService, keyName, "", WithReplicaKeyURIs(keyName, unreachableKeyName))
+	if _, err := p.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("foo")}); err == nil {
+		t.Fatal("Expected encrypt to fail while a replica key is unreachable")
+	}
+
+	p = NewPlugin(tt.plugin.keyService, keyName, "", WithReplicaKeyURIs(keyName, unreachableKeyName), WithMinReplicaCopies(1))
+	if _, err := p.Encrypt(ctx, &EncryptRequest{Plaintext: []byte("foo")}); err != nil {
+		t.Fatalf("Failed to encrypt with one of two replica keys, error: %v", err)
+	}
+}
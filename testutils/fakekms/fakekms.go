@@ -16,9 +16,11 @@
 package fakekms
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -96,6 +98,20 @@ func (f *Server) TestIAMRequestsEqual(r []*cloudkms.TestIamPermissionsRequest) e
 	return nil
 }
 
+// EncryptRequestsCount returns the number of EncryptRequests processed by the server.
+func (f *Server) EncryptRequestsCount() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return len(f.encryptRequestLog)
+}
+
+// DecryptRequestsCount returns the number of DecryptRequests processed by the server.
+func (f *Server) DecryptRequestsCount() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return len(f.decryptRequestLog)
+}
+
 func (f *Server) recordEncryptRequest(r *cloudkms.EncryptRequest) {
 	f.mux.Lock()
 	defer f.mux.Unlock()
@@ -124,13 +140,33 @@ func NewWithPipethrough(keyName string, port int) (*Server, error) {
 
 		switch r := req.(type) {
 		case *cloudkms.EncryptRequest:
+			crc, err := checksum(r.Plaintext)
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+			aadCRC, err := checksum(r.AdditionalAuthenticatedData)
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
 			return &cloudkms.EncryptResponse{
-				Name:       keyName,
-				Ciphertext: r.Plaintext,
+				Name:                    keyName,
+				Ciphertext:              r.Plaintext,
+				CiphertextCrc32c:        crc,
+				VerifiedPlaintextCrc32c: r.PlaintextCrc32c == crc,
+				VerifiedAdditionalAuthenticatedDataCrc32c: r.AdditionalAuthenticatedDataCrc32c != 0 && r.AdditionalAuthenticatedDataCrc32c == aadCRC,
 			}, http.StatusOK, nil
 		case *cloudkms.DecryptRequest:
+			crc, err := checksum(r.Ciphertext)
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+			// Like Cloud KMS, reject requests corrupted in transit.
+			if r.CiphertextCrc32c != crc {
+				return nil, http.StatusBadRequest, errors.New("The checksum in field ciphertext_crc32c did not match the data in field ciphertext.")
+			}
 			return &cloudkms.DecryptResponse{
-				Plaintext: r.Ciphertext,
+				Plaintext:       r.Ciphertext,
+				PlaintextCrc32c: crc,
 			}, http.StatusOK, nil
 		case *cloudkms.TestIamPermissionsRequest:
 			return &cloudkms.TestIamPermissionsResponse{
@@ -139,6 +175,16 @@ func NewWithPipethrough(keyName string, port int) (*Server, error) {
 					"cloudkms.cryptoKeyVersions.useToDecrypt",
 				},
 			}, http.StatusOK, nil
+		case *cloudkms.CryptoKey:
+			return &cloudkms.CryptoKey{
+				Name:    keyName,
+				Purpose: "ENCRYPT_DECRYPT",
+				Primary: &cloudkms.CryptoKeyVersion{
+					Name:            keyName + "/cryptoKeyVersions/1",
+					State:           "ENABLED",
+					ProtectionLevel: "SOFTWARE",
+				},
+			}, http.StatusOK, nil
 		default:
 			return nil, http.StatusInternalServerError, fmt.Errorf("was not expecting request type:%T", r)
 		}
@@ -147,6 +193,36 @@ func NewWithPipethrough(keyName string, port int) (*Server, error) {
 	return newWithCallback(keyName, port, 0, handle)
 }
 
+// checksum computes CRC32C of base64 encoded data, as Cloud KMS does.
+func checksum(data string) (int64, error) {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return 0, err
+	}
+	return int64(crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli))), nil
+}
+
+// ErrorResponse is an error returned by Cloud KMS, it answers a request of any type.
+type ErrorResponse struct {
+	// Code is the HTTP status code.
+	Code int
+	// Status is the canonical code, ex. FAILED_PRECONDITION.
+	Status  string
+	Message string
+}
+
+// MarshalJSON encodes e the way Cloud KMS does.
+func (e *ErrorResponse) MarshalJSON() ([]byte, error) {
+	type status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	}
+	return json.Marshal(struct {
+		Error status `json:"error"`
+	}{status{e.Code, e.Message, e.Status}})
+}
+
 // NewWithResponses creates and returns *Server.
 // It is the responsibility of the caller to supply the expected number of Responses.
 // When the provided Responses are exhausted an error will be returned.
@@ -158,6 +234,10 @@ func NewWithResponses(keyName string, port int, delay time.Duration, responses .
 		if len(responses) == 0 {
 			return nil, http.StatusServiceUnavailable, errors.New("list of responses is empty")
 		}
+		if e, ok := responses[0].(*ErrorResponse); ok {
+			responses = responses[1:]
+			return e, e.Code, nil
+		}
 
 		status := http.StatusInternalServerError
 		switch req.(type) {
@@ -179,6 +259,24 @@ func NewWithResponses(keyName string, port int, delay time.Duration, responses .
 				return nil, status, errors.New("request for testIamPermissions does not have a corresponding response of cloudkms.TestIAMPermissionResponse")
 			}
 			status = t.HTTPStatusCode
+		case *cloudkms.PublicKey:
+			k, ok := responses[0].(*cloudkms.PublicKey)
+			if !ok {
+				return nil, status, errors.New("request for getPublicKey does not have a corresponding response of cloudkms.PublicKey")
+			}
+			status = k.HTTPStatusCode
+		case *cloudkms.AsymmetricDecryptRequest:
+			d, ok := responses[0].(*cloudkms.AsymmetricDecryptResponse)
+			if !ok {
+				return nil, status, errors.New("request for asymmetricDecrypt does not have a corresponding response of cloudkms.AsymmetricDecryptResponse")
+			}
+			status = d.HTTPStatusCode
+		case *cloudkms.CryptoKey:
+			k, ok := responses[0].(*cloudkms.CryptoKey)
+			if !ok {
+				return nil, status, errors.New("request for get does not have a corresponding response of cloudkms.CryptoKey")
+			}
+			status = k.HTTPStatusCode
 		}
 		r := responses[0]
 		responses = responses[1:]
@@ -251,8 +349,35 @@ func newWithCallback(keyName string, port int, delay time.Duration, handle func(
 				http.Error(w, err.Error(), status)
 				return
 			}
+		case fmt.Sprintf("/v1/%s:asymmetricDecrypt", keyName):
+			d := &cloudkms.AsymmetricDecryptRequest{}
+			if err := json.Unmarshal(body, d); err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+
+			response, status, err = handle(d)
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+		case fmt.Sprintf("/v1/%s/publicKey", keyName):
+			// GetPublicKey does not have a request body, an empty PublicKey stands for the request.
+			response, status, err = handle(&cloudkms.PublicKey{})
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+		case fmt.Sprintf("/v1/%s", keyName):
+			// CryptoKeys.Get does not have a request body, an empty CryptoKey stands for the request.
+			response, status, err = handle(&cloudkms.CryptoKey{})
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
 		default:
-			http.Error(w, fmt.Sprintf("Was not expecting call to %q", r.URL.EscapedPath()), status)
+			// Like Cloud KMS for a key that does not exist.
+			http.Error(w, fmt.Sprintf("Was not expecting call to %q", r.URL.EscapedPath()), http.StatusNotFound)
 			return
 		}
 